@@ -0,0 +1,117 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+
+	actionqueue "github.com/m13253/actionqueue-go"
+)
+
+// actionQueue is implemented by *actionqueue.Queue, which always runs on the
+// system clock, and by virtualActionQueue.
+type actionQueue interface {
+	AddAction(value interface{}, actionTime time.Time)
+	AddActionWithExpiry(value interface{}, actionTime, expireTime time.Time)
+	NextAction() <-chan *actionqueue.Action
+}
+
+// virtualActionQueue behaves like actionqueue.Queue, but it does not run in
+// the background. Actions are taken out with PopAction according to its
+// clock, which is usually a virtualClock.
+//
+// It is not safe for concurrent use.
+type virtualActionQueue struct {
+	clock   clock
+	actions []*actionqueue.Action
+}
+
+func newVirtualActionQueue(clock clock) *virtualActionQueue {
+	return &virtualActionQueue{
+		clock: clock,
+	}
+}
+
+func (q *virtualActionQueue) AddAction(value interface{}, actionTime time.Time) {
+	q.pushAction(&actionqueue.Action{
+		Value:      value,
+		ActionTime: actionTime,
+	})
+}
+
+func (q *virtualActionQueue) AddActionWithExpiry(value interface{}, actionTime, expireTime time.Time) {
+	now := q.clock.Now()
+	if expireTime.IsZero() || now.Before(expireTime) {
+		q.pushAction(&actionqueue.Action{
+			Value:      value,
+			ActionTime: actionTime,
+			ExpireTime: expireTime,
+		})
+	}
+}
+
+// NextAction returns a nil channel, use PopAction instead.
+func (q *virtualActionQueue) NextAction() <-chan *actionqueue.Action {
+	return nil
+}
+
+// NextActionTime returns when the next action is due.
+func (q *virtualActionQueue) NextActionTime() (time.Time, bool) {
+	if len(q.actions) == 0 {
+		return time.Time{}, false
+	}
+	actionTime := q.actions[0].ActionTime
+	if now := q.clock.Now(); actionTime.Before(now) {
+		actionTime = now
+	}
+	return actionTime, true
+}
+
+// PopAction removes and returns the next action due at now, or nil if there
+// is none. Expired actions are discarded on the way.
+func (q *virtualActionQueue) PopAction(now time.Time) *actionqueue.Action {
+	for len(q.actions) != 0 {
+		nextAction := q.actions[0]
+		if !nextAction.ExpireTime.IsZero() && !now.Before(nextAction.ExpireTime) {
+			q.actions = q.actions[1:]
+			continue
+		}
+		if !nextAction.ActionTime.IsZero() && now.Before(nextAction.ActionTime) {
+			return nil
+		}
+		q.actions = q.actions[1:]
+		return nextAction
+	}
+	return nil
+}
+
+func (q *virtualActionQueue) pushAction(a *actionqueue.Action) {
+	i := len(q.actions)
+	for i > 0 && a.ActionTime.Before(q.actions[i-1].ActionTime) {
+		i--
+	}
+	q.actions = append(q.actions, nil)
+	copy(q.actions[i+1:], q.actions[i:])
+	q.actions[i] = a
+}
@@ -0,0 +1,223 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clock is the source of time for the playback, realtime and keystroke
+// goroutines. It is replaced by a virtualClock when timing has to be
+// simulated.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) clockTimer
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+type clockTimer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) clockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// virtualClock only moves forward when Advance, AdvanceTo or Sleep is called.
+//
+// Timers fire in the order of their deadlines while the clock is advanced,
+// timers sharing the same deadline fire in the order they were created.
+// Unlike time.Timer, Reset and Stop discard any value not yet received from
+// the channel.
+type virtualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock    *virtualClock
+	c        chan time.Time
+	f        func()
+	deadline time.Time
+	active   bool
+}
+
+func newVirtualClock(now time.Time) *virtualClock {
+	return &virtualClock{
+		now: now,
+	}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mutex.Lock()
+	now := c.now
+	c.mutex.Unlock()
+	return now
+}
+
+// Sleep returns immediately after advancing the clock by d.
+func (c *virtualClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *virtualClock) NewTimer(d time.Duration) clockTimer {
+	t := &virtualTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	c.mutex.Lock()
+	c.timers = append(c.timers, t)
+	c.mutex.Unlock()
+	t.Reset(d)
+	return t
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := &virtualTimer{
+		clock: c,
+		f:     f,
+	}
+	c.mutex.Lock()
+	c.timers = append(c.timers, t)
+	c.mutex.Unlock()
+	t.Reset(d)
+	return t
+}
+
+func (c *virtualClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo moves the clock to t, firing every timer due on the way.
+// Timers created or reset by an AfterFunc callback also fire if they are due
+// before t.
+func (c *virtualClock) AdvanceTo(t time.Time) {
+	for {
+		c.mutex.Lock()
+		next := c.nextTimer()
+		if next == nil || next.deadline.After(t) {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.mutex.Unlock()
+			return
+		}
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+		next.active = false
+		now := c.now
+		c.mutex.Unlock()
+
+		if next.f != nil {
+			next.f()
+		} else {
+			select {
+			case next.c <- now:
+			default:
+			}
+		}
+	}
+}
+
+// NextDeadline returns the deadline of the earliest active timer.
+func (c *virtualClock) NextDeadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	next := c.nextTimer()
+	if next == nil {
+		return time.Time{}, false
+	}
+	return next.deadline, true
+}
+
+func (c *virtualClock) nextTimer() *virtualTimer {
+	var next *virtualTimer
+	for _, t := range c.timers {
+		if t.active && (next == nil || t.deadline.Before(next.deadline)) {
+			next = t
+		}
+	}
+	return next
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	return wasActive
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.active = false
+	return wasActive
+}
+
+func (t *virtualTimer) drain() {
+	if t.c == nil {
+		return
+	}
+	select {
+	case <-t.c:
+	default:
+	}
+}
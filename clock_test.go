@@ -0,0 +1,128 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVirtualClockOrder(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	c := newVirtualClock(start)
+	fired := []string{}
+	c.AfterFunc(30*time.Millisecond, func() { fired = append(fired, "c") })
+	c.AfterFunc(10*time.Millisecond, func() { fired = append(fired, "a") })
+	// Same deadline as "a", created later
+	c.AfterFunc(10*time.Millisecond, func() {
+		fired = append(fired, "b")
+		// Due before the end of the Advance, so it fires in the same call
+		c.AfterFunc(5*time.Millisecond, func() { fired = append(fired, "b2") })
+	})
+
+	deadline, ok := c.NextDeadline()
+	if !ok || !deadline.Equal(start.Add(10*time.Millisecond)) {
+		t.Fatalf("NextDeadline() = %v, %v, want %v", deadline, ok, start.Add(10*time.Millisecond))
+	}
+	c.Advance(20 * time.Millisecond)
+	if want := []string{"a", "b", "b2"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %q, want %q", fired, want)
+	}
+	if now := c.Now(); !now.Equal(start.Add(20 * time.Millisecond)) {
+		t.Fatalf("Now() = %v, want %v", now, start.Add(20*time.Millisecond))
+	}
+	c.Advance(time.Second)
+	if want := []string{"a", "b", "b2", "c"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %q, want %q", fired, want)
+	}
+	if _, ok := c.NextDeadline(); ok {
+		t.Fatal("NextDeadline() reports a timer after all of them fired")
+	}
+}
+
+func TestVirtualTimerResetStop(t *testing.T) {
+	start := time.Unix(0, 0).UTC()
+	c := newVirtualClock(start)
+	timer := c.NewTimer(10 * time.Millisecond)
+
+	// Reset moves the deadline from the current time
+	c.Advance(5 * time.Millisecond)
+	if !timer.Reset(10 * time.Millisecond) {
+		t.Fatal("Reset() of an active timer returned false")
+	}
+	c.Advance(5 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired at its old deadline")
+	default:
+	}
+	deadline, ok := c.NextDeadline()
+	if !ok || !deadline.Equal(start.Add(15*time.Millisecond)) {
+		t.Fatalf("NextDeadline() = %v, %v, want %v", deadline, ok, start.Add(15*time.Millisecond))
+	}
+	c.Advance(10 * time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(15 * time.Millisecond)) {
+			t.Fatalf("timer fired at %v, want %v", now, start.Add(15*time.Millisecond))
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+
+	// Stop prevents firing, and discards a value not yet received
+	timer.Reset(0)
+	c.Advance(0)
+	if timer.Stop() {
+		t.Fatal("Stop() of a fired timer returned true")
+	}
+	select {
+	case <-timer.C():
+		t.Fatal("Stop() did not drain the channel")
+	default:
+	}
+	timer.Reset(10 * time.Millisecond)
+	if !timer.Stop() {
+		t.Fatal("Stop() of an active timer returned false")
+	}
+	if _, ok := c.NextDeadline(); ok {
+		t.Fatal("NextDeadline() reports a stopped timer")
+	}
+	c.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	// Sleep advances the clock and fires the timers on the way
+	timer.Reset(10 * time.Millisecond)
+	c.Sleep(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("timer did not fire during Sleep")
+	}
+}
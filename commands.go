@@ -0,0 +1,332 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// midiRealtimeSnapshot is a copy of the state owned by MidiRealtimeGoro.
+type midiRealtimeSnapshot struct {
+	MidiInDevices    []string
+	MidiInDevice     int
+	MidiInMuted      bool
+	ControlDevice    int
+	MidiOutDevices   []string
+	MidiOutDevice    int
+	MidiOutBank      uint16
+	MidiOutPatch     uint8
+	MidiOutTranspose int
+	ChannelRouting   [16]midiChannelRoute
+	SplitZones       []splitZone
+	LearnActive      bool
+	LearnNote        int
+}
+
+// midiPlaybackSnapshot is a copy of the state owned by MidiPlaybackGoro.
+// Sequence is shared and must not be modified.
+type midiPlaybackSnapshot struct {
+	Sequence         *midimark.Sequence
+	Tracks           []uint16
+	Channels         uint16
+	Offset           time.Duration
+	Speed            float64
+	ScheduleEnabled  bool
+	Schedule         time.Time
+	LoopEnabled      bool
+	Loop             time.Duration
+	OutOfRangePolicy string
+}
+
+// ntpSnapshot is a copy of the state owned by NtpGoro.
+type ntpSnapshot struct {
+	Server       string
+	Synced       bool
+	LastSync     time.Time
+	ClockOffset  time.Duration
+	MaxDeviation time.Duration
+}
+
+func (app *application) snapshotMidiRealtime() (snapshot midiRealtimeSnapshot, err error) {
+	_, err = app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		snapshot = midiRealtimeSnapshot{
+			MidiInDevices:    app.listMidiInDevices(),
+			MidiInDevice:     app.MidiInDevice,
+			MidiInMuted:      app.MidiInMuted,
+			ControlDevice:    app.MidiControlDevice,
+			MidiOutDevices:   app.listMidiOutDevices(),
+			MidiOutDevice:    app.MidiOutDevice,
+			MidiOutBank:      app.MidiOutBank,
+			MidiOutPatch:     app.MidiOutPatch,
+			MidiOutTranspose: app.MidiOutTranspose,
+			ChannelRouting:   app.MidiChannelRouting,
+			SplitZones:       append([]splitZone(nil), app.MidiSplitZones...),
+			LearnActive:      app.MidiLearnActive,
+			LearnNote:        app.MidiLearnNote,
+		}
+		return nil, nil
+	})
+	return
+}
+
+func (app *application) snapshotMidiPlayback() (snapshot midiPlaybackSnapshot, err error) {
+	_, err = app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		snapshot = midiPlaybackSnapshot{
+			Sequence:         app.midiFileBuffer.sequence,
+			Tracks:           append([]uint16(nil), app.MidiPlaybackTracks...),
+			Channels:         app.MidiPlaybackChannels,
+			Offset:           app.MidiPlaybackOffset,
+			Speed:            app.MidiPlaybackSpeed,
+			ScheduleEnabled:  app.MidiPlaybackScheduleEnabled,
+			Schedule:         app.MidiPlaybackSchedule,
+			LoopEnabled:      app.MidiPlaybackLoopEnabled,
+			Loop:             app.MidiPlaybackLoop,
+			OutOfRangePolicy: app.MidiPlaybackOutOfRangePolicy,
+		}
+		return nil, nil
+	})
+	return
+}
+
+// snapshotKeybindings returns the keybindings in use, which may have been
+// changed on the web console since the config file was loaded.
+func (app *application) snapshotKeybindings() (keybindings [128]keybindingPreset, err error) {
+	_, err = app.KeystrokeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		keybindings = app.keyStatus.keybinding
+		return nil, nil
+	})
+	return
+}
+
+// snapshotKeybindingProfile returns the name of the keybinding profile in use.
+func (app *application) snapshotKeybindingProfile() (name string, err error) {
+	_, err = app.KeystrokeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		name = app.keyStatus.keybindingProfile
+		return nil, nil
+	})
+	return
+}
+
+// snapshotNtp does not wait for NtpGoro, which may be busy syncing.
+func (app *application) snapshotNtp() ntpSnapshot {
+	app.ntpMutex.RLock()
+	defer app.ntpMutex.RUnlock()
+	return ntpSnapshot{
+		Server:       app.NtpSyncServer,
+		Synced:       !app.NtpLastSync.IsZero(),
+		LastSync:     app.NtpLastSync,
+		ClockOffset:  app.NtpClockOffset,
+		MaxDeviation: app.NtpMaxDeviation,
+	}
+}
+
+func (app *application) cmdOpenMidiInDevice(midiInDevice int) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.openMidiInDevice(midiInDevice)
+	})
+	return err
+}
+
+func (app *application) cmdOpenMidiControlDevice(midiControlDevice int) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.openMidiControlDevice(midiControlDevice)
+	})
+	return err
+}
+
+func (app *application) cmdOpenMidiOutDevice(midiOutDevice int) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.openMidiOutDevice(midiOutDevice)
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiOutBank(midiOutBank uint16) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiOutBank(midiOutBank)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiOutPatch(midiOutPatch uint8) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiOutPatch(midiOutPatch)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiOutTranspose(midiOutTranspose int) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiOutTranspose(midiOutTranspose)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiChannelRoute(channel int, route midiChannelRoute) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiChannelRoute(channel, route)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiSplitZones(zones []splitZone) error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiSplitZones(zones)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdStartMidiLearn() error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.startMidiLearn()
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdStopMidiLearn() error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.stopMidiLearn()
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetKeybinding(note uint8, keybind keybindingPreset) error {
+	_, err := app.KeystrokeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setKeybinding(note, keybind)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetDefaultKeybindings(keybindings *[128]keybindingPreset) error {
+	_, err := app.KeystrokeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setDefaultKeybindings(keybindings)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetKeybindingProfile(name string) error {
+	_, err := app.KeystrokeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.setKeybindingProfile(name)
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackFile(midiFile io.ReadSeeker) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.setMidiPlaybackFile(midiFile)
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackTracks(tracks []uint16) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackTracks(tracks)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackChannels(channels uint16) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackChannels(channels)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackOffset(offset time.Duration) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackOffset(offset)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackSpeed(speed float64) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.setMidiPlaybackSpeed(speed)
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackScheduler(enabled bool, startTime time.Time, loopEnabled bool, loopInterval time.Duration) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackScheduler(enabled, startTime, loopEnabled, loopInterval)
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSetMidiPlaybackOutOfRangePolicy(policy string) error {
+	_, err := app.MidiPlaybackGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackOutOfRangePolicy(policy)
+		return nil, nil
+	})
+	return err
+}
+
+// cmdStopMidiPlayback disables the scheduler without waiting for the result,
+// so it is safe to call from the window procedure.
+func (app *application) cmdStopMidiPlayback() {
+	_ = app.MidiPlaybackGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+		app.setMidiPlaybackScheduler(false, app.MidiPlaybackSchedule, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop)
+		return nil, nil
+	})
+}
+
+// cmdEmergencyStop does not wait for the result either.
+func (app *application) cmdEmergencyStop() {
+	_ = app.MidiRealtimeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+		app.emergencyStop()
+		return nil, nil
+	})
+}
+
+func (app *application) cmdRearmMidiIn() error {
+	_, err := app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		app.rearmMidiIn()
+		return nil, nil
+	})
+	return err
+}
+
+func (app *application) cmdSyncTime(ntpServer string) error {
+	_, err := app.NtpGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
+		return nil, app.syncTime(ntpServer)
+	})
+	return err
+}
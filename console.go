@@ -0,0 +1,313 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultNtpServer = "0.beevik-ntp.pool.ntp.org"
+
+const consoleHelp = `Commands:
+  status                  Show devices, playback and clock status
+  devices                 List MIDI devices
+  input <n|off>           Open MIDI input device
+  output <n|off>          Open MIDI output device
+  control <n|off>         Open remote-control device
+  load <path>             Load a MIDI file for playback
+  tracks                  List the tracks of the MIDI file
+  track <n>[,<n>...]      Select playback tracks, merged into one
+  channels <n,...|all>    Select playback channels
+  transpose <n>           Set transpose in semitones
+  offset <seconds>        Set playback offset
+  speed <factor>          Set playback speed, 0.25 to 4
+  start [now|+5s|HH:MM:SS]  Schedule playback
+  stop                    Stop playback
+  sync [server]           Sync time with an NTP server
+  reload                  Reload the config file
+  emergency-stop          Stop everything and release all keys
+  rearm                   Re-arm muted MIDI input`
+
+// readConsoleCommands runs one command per line until r is closed.
+func (app *application) readConsoleCommands(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		app.runConsoleCommand(scanner.Text())
+	}
+}
+
+// runConsoleCommand calls the same cmd* and snapshot* functions as the web
+// handlers, so it must not be called from an executor.
+func (app *application) runConsoleCommand(line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	argument := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "help", "?":
+		fmt.Println(consoleHelp)
+		return
+	case "status":
+		err = app.printConsoleStatus()
+		if err == nil {
+			return
+		}
+	case "devices":
+		err = app.printConsoleDevices()
+		if err == nil {
+			return
+		}
+	case "input":
+		err = app.runConsoleOpenDevice(argument, app.cmdOpenMidiInDevice)
+	case "output":
+		err = app.runConsoleOpenDevice(argument, app.cmdOpenMidiOutDevice)
+	case "control":
+		err = app.runConsoleOpenDevice(argument, app.cmdOpenMidiControlDevice)
+	case "load":
+		err = app.runConsoleLoad(argument)
+	case "tracks":
+		err = app.printConsoleTracks()
+		if err == nil {
+			return
+		}
+	case "track":
+		var tracks []uint16
+		tracks, err = parseMidiTrackList(argument)
+		if err == nil {
+			err = app.cmdSetMidiPlaybackTracks(tracks)
+		}
+	case "channels":
+		var channels uint16
+		channels, err = parseMidiChannelList(argument)
+		if err == nil {
+			err = app.cmdSetMidiPlaybackChannels(channels)
+		}
+	case "transpose":
+		var value int64
+		value, err = strconv.ParseInt(argument, 0, 8)
+		if err == nil {
+			err = app.cmdSetMidiOutTranspose(int(value))
+		}
+	case "offset":
+		var value float64
+		value, err = strconv.ParseFloat(argument, 64)
+		if err == nil {
+			err = app.cmdSetMidiPlaybackOffset(time.Duration(value*1e9) * time.Nanosecond)
+		}
+	case "speed":
+		var value float64
+		value, err = strconv.ParseFloat(strings.TrimSuffix(argument, "x"), 64)
+		if err == nil {
+			err = app.cmdSetMidiPlaybackSpeed(value)
+		}
+	case "start":
+		err = app.runConsoleStart(argument)
+	case "stop":
+		var snapshot midiPlaybackSnapshot
+		snapshot, err = app.snapshotMidiPlayback()
+		if err == nil {
+			err = app.cmdSetMidiPlaybackScheduler(false, snapshot.Schedule, snapshot.LoopEnabled, snapshot.Loop)
+		}
+	case "sync":
+		if argument == "" {
+			argument = app.snapshotNtp().Server
+		}
+		if argument == "" {
+			argument = defaultNtpServer
+		}
+		fmt.Printf("Syncing time with %s...\n", argument)
+		err = app.cmdSyncTime(argument)
+	case "reload":
+		err = app.reloadConfigFile()
+	case "emergency-stop":
+		log.Println("Emergency stop requested on the console!")
+		app.cmdEmergencyStop()
+	case "rearm":
+		err = app.cmdRearmMidiIn()
+	default:
+		err = fmt.Errorf("unknown command %q, type \"help\" for a list of commands", fields[0])
+	}
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	fmt.Println("OK")
+}
+
+func (app *application) runConsoleOpenDevice(argument string, open func(int) error) error {
+	if argument == "off" {
+		return open(-1)
+	}
+	value, err := strconv.ParseInt(argument, 0, 0)
+	if err != nil {
+		return err
+	}
+	return open(int(value))
+}
+
+func (app *application) runConsoleLoad(path string) error {
+	if path == "" {
+		return fmt.Errorf("missing file name")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return app.cmdSetMidiPlaybackFile(f)
+}
+
+// runConsoleStart accepts "now", a duration from now like "+10s", or a wall
+// clock time like "21:30:00". Times are in the synced clock.
+func (app *application) runConsoleStart(argument string) error {
+	now := app.clock.Now().Add(app.snapshotNtp().ClockOffset)
+	startTime := now
+	switch {
+	case argument == "" || argument == "now":
+	case strings.HasPrefix(argument, "+"):
+		delay, err := time.ParseDuration(argument[1:])
+		if err != nil {
+			return err
+		}
+		startTime = now.Add(delay)
+	default:
+		var clockTime time.Time
+		var err error
+		for _, layout := range []string{"15:04:05.999999999", "15:04"} {
+			clockTime, err = time.ParseInLocation(layout, argument, time.Local)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid start time %q", argument)
+		}
+		now = now.Local()
+		startTime = time.Date(now.Year(), now.Month(), now.Day(), clockTime.Hour(), clockTime.Minute(), clockTime.Second(), clockTime.Nanosecond(), time.Local)
+		if startTime.Before(now) {
+			startTime = startTime.AddDate(0, 0, 1)
+		}
+	}
+	snapshot, err := app.snapshotMidiPlayback()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Playback starts at %s.\n", startTime.Local().Format("15:04:05.000"))
+	return app.cmdSetMidiPlaybackScheduler(true, startTime, snapshot.LoopEnabled, snapshot.Loop)
+}
+
+func (app *application) printConsoleDevices() error {
+	snapshot, err := app.snapshotMidiRealtime()
+	if err != nil {
+		return err
+	}
+	fmt.Println("MIDI input devices:")
+	for i, name := range snapshot.MidiInDevices {
+		fmt.Printf("  %d: %s\n", i, name)
+	}
+	fmt.Println("MIDI output devices:")
+	for i, name := range snapshot.MidiOutDevices {
+		fmt.Printf("  %d: %s\n", i, name)
+	}
+	return nil
+}
+
+func (app *application) printConsoleTracks() error {
+	snapshot, err := app.snapshotMidiPlayback()
+	if err != nil {
+		return err
+	}
+	if snapshot.Sequence == nil {
+		return fmt.Errorf("no MIDI file loaded")
+	}
+	for i, thisTrack := range snapshot.Sequence.Tracks {
+		fmt.Printf("  %d: %s (%d events)\n", i, midiTrackName(thisTrack), len(thisTrack.Events))
+	}
+	return nil
+}
+
+func (app *application) printConsoleStatus() error {
+	realtime, err := app.snapshotMidiRealtime()
+	if err != nil {
+		return err
+	}
+	playback, err := app.snapshotMidiPlayback()
+	if err != nil {
+		return err
+	}
+	ntp := app.snapshotNtp()
+
+	deviceName := func(devices []string, device int) string {
+		if device < 0 || device >= len(devices) {
+			return "off"
+		}
+		return fmt.Sprintf("%d: %s", device, devices[device])
+	}
+	muted := ""
+	if realtime.MidiInMuted {
+		muted = " (muted)"
+	}
+	fmt.Printf("MIDI input:     %s%s\n", deviceName(realtime.MidiInDevices, realtime.MidiInDevice), muted)
+	fmt.Printf("Remote control: %s\n", deviceName(realtime.MidiInDevices, realtime.ControlDevice))
+	fmt.Printf("MIDI output:    %s\n", deviceName(realtime.MidiOutDevices, realtime.MidiOutDevice))
+	fmt.Printf("Transpose:      %+d\n", realtime.MidiOutTranspose)
+
+	if playback.Sequence == nil {
+		fmt.Println("MIDI file:      none")
+	} else {
+		fmt.Printf("MIDI file:      %d tracks\n", len(playback.Sequence.Tracks))
+	}
+	fmt.Printf("Tracks:         %v\n", playback.Tracks)
+	if playback.Channels == allMidiChannels {
+		fmt.Println("Channels:       all")
+	} else {
+		fmt.Printf("Channels:       %v\n", midiChannelList(playback.Channels))
+	}
+	fmt.Printf("Offset:         %s\n", playback.Offset)
+	fmt.Printf("Speed:          %gx\n", playback.Speed)
+	switch {
+	case playback.ScheduleEnabled && playback.LoopEnabled:
+		fmt.Printf("Scheduler:      start at %s, loop every %s\n", playback.Schedule.Local().Format("15:04:05.000"), playback.Loop)
+	case playback.ScheduleEnabled:
+		fmt.Printf("Scheduler:      start at %s\n", playback.Schedule.Local().Format("15:04:05.000"))
+	default:
+		fmt.Println("Scheduler:      stopped")
+	}
+
+	if ntp.Synced {
+		fmt.Printf("NTP:            %s, offset %s, max deviation %s\n", ntp.Server, ntp.ClockOffset, ntp.MaxDeviation)
+	} else {
+		fmt.Println("NTP:            not synced")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConsoleStart(t *testing.T) {
+	app := newWebTest(t, defaultPreset).app
+
+	before := time.Now()
+	app.runConsoleCommand("start +5s")
+	after := time.Now()
+	snapshot, err := app.snapshotMidiPlayback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.ScheduleEnabled || snapshot.Schedule.Before(before.Add(5*time.Second)) || snapshot.Schedule.After(after.Add(5*time.Second)) {
+		t.Errorf("start +5s: got %v at %s, want between %s and %s", snapshot.ScheduleEnabled, snapshot.Schedule, before.Add(5*time.Second), after.Add(5*time.Second))
+	}
+	app.runConsoleCommand("stop")
+
+	// An hour ago is tomorrow
+	for _, offset := range []time.Duration{time.Hour, -time.Hour} {
+		clockTime := time.Now().Add(offset).Local().Format("15:04:05")
+		app.runConsoleCommand("start " + clockTime)
+		snapshot, err = app.snapshotMidiPlayback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		if !snapshot.ScheduleEnabled || snapshot.Schedule.Local().Format("15:04:05") != clockTime || snapshot.Schedule.Before(now) || snapshot.Schedule.After(now.Add(24*time.Hour)) {
+			t.Errorf("start %s: got %v at %s", clockTime, snapshot.ScheduleEnabled, snapshot.Schedule)
+		}
+		app.runConsoleCommand("stop")
+	}
+
+	for _, argument := range []string{"+5", "25:00:00", "soon"} {
+		if err := app.runConsoleStart(argument); err == nil {
+			t.Errorf("start %s: got no error", argument)
+		}
+	}
+}
+
+func TestConsoleUnknownCommand(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+
+	app := &application{preset: defaultPreset}
+	app.runConsoleCommand("frobnicate now")
+	want := "Error:  unknown command \"frobnicate\", type \"help\" for a list of commands\n"
+	if logged.String() != want {
+		t.Errorf("got %q, want %q", logged.String(), want)
+	}
+
+	// Blank lines are ignored
+	logged.Reset()
+	app.runConsoleCommand("  ")
+	if logged.Len() != 0 {
+		t.Errorf("blank line: got %q", logged.String())
+	}
+}
@@ -0,0 +1,284 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	cgc "github.com/m13253/cgc-go"
+	"github.com/m13253/midimark"
+)
+
+// dryRunEntry is one line of a dry-run timeline.
+// Time is in seconds relative to the scheduled start of playback.
+type dryRunEntry struct {
+	Time   float64 `json:"time"`
+	Event  string  `json:"event"`
+	Key    string  `json:"key,omitempty"`
+	Note   string  `json:"note,omitempty"`
+	Delay  float64 `json:"delay,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+type dryRunTimeline struct {
+	// Track is the first one of Tracks
+	Track     uint16        `json:"track"`
+	Tracks    []uint16      `json:"tracks"`
+	Channels  []int         `json:"channels"`
+	Transpose int           `json:"transpose"`
+	Speed     float64       `json:"speed"`
+	Entries   []dryRunEntry `json:"entries"`
+
+	app       *application
+	startTime time.Time
+}
+
+// dryRunOptions is the state a dry run uses instead of the live one.
+// A zero Speed plays at the normal speed.
+type dryRunOptions struct {
+	Tracks           []uint16
+	Channels         uint16
+	Transpose        int
+	Speed            float64
+	OutOfRangePolicy string
+	ChannelRouting   [16]midiChannelRoute
+	Keybinding       [128]keybindingPreset
+}
+
+// dryRunMidiPlayback plays the merged tracks through addMidiEvent and produceKeystroke
+// on a virtual clock, and records what keys would be pressed.
+//
+// The simulation runs on a copy of the preset, so it is safe to call from any
+// goroutine, as long as sequence is not modified.
+func (app *application) dryRunMidiPlayback(sequence *midimark.Sequence, options *dryRunOptions) (*dryRunTimeline, error) {
+	transpose := options.Transpose
+	speed := options.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	events, err := mergeMidiTracks(sequence, options.Tracks, options.Channels)
+	if err != nil {
+		return nil, err
+	}
+
+	sim := &application{
+		preset:                       app.preset,
+		MidiInDevice:                 -1,
+		MidiOutDevice:                -1,
+		MidiOutTranspose:             transpose,
+		MidiChannelRouting:           options.ChannelRouting,
+		MidiLearnNote:                -1,
+		MidiPlaybackTracks:           options.Tracks,
+		MidiPlaybackChannels:         options.Channels,
+		MidiPlaybackSpeed:            speed,
+		MidiPlaybackOutOfRangePolicy: options.OutOfRangePolicy,
+	}
+	sim.Keybinding = options.Keybinding
+	sim.ctx, sim.Quit = context.WithCancel(app.ctx)
+	defer sim.Quit()
+
+	// Playback starts at startTime, but the first modifiers are switched
+	// ModifierCooldown earlier, so begin the simulation with some margin.
+	startTime := time.Unix(0, 0).UTC()
+	clock := newVirtualClock(startTime.Add(-app.ModifierCooldown - time.Second))
+	sim.clock = clock
+
+	sim.KeystrokeGoro = cgc.NewBuffered(1)
+	sim.MidiRealtimeGoro = cgc.NewBuffered(1)
+	sim.NtpGoro = cgc.NewBuffered(1)
+	sim.MidiPlaybackGoro = cgc.NewBuffered(1)
+
+	timeline := &dryRunTimeline{
+		Track:     options.Tracks[0],
+		Tracks:    options.Tracks,
+		Channels:  midiChannelList(options.Channels),
+		Transpose: transpose,
+		Speed:     speed,
+		Entries:   []dryRunEntry{},
+		app:       sim,
+		startTime: startTime,
+	}
+	sim.keySender = timeline
+	sim.keystrokeTrace = timeline.addTraceEvent
+
+	keystrokeQueue := newVirtualActionQueue(clock)
+	sim.keystrokeQueue = keystrokeQueue
+	midiOutQueue := newVirtualActionQueue(clock)
+	sim.midiOutQueue = midiOutQueue
+
+	sim.ntpMutex = new(sync.RWMutex)
+
+	sim.initKeystrokes()
+	sim.initMidiPlayback()
+	sim.midiFileBuffer.sequence = sequence
+	sim.midiFileBuffer.events = events
+	sim.setMidiPlaybackScheduler(true, startTime, false, 0)
+
+	for {
+		if sim.runOneDryRunStep(clock, keystrokeQueue, midiOutQueue) {
+			continue
+		}
+		nextTime, ok := clock.NextDeadline()
+		if actionTime, ok2 := keystrokeQueue.NextActionTime(); ok2 && (!ok || actionTime.Before(nextTime)) {
+			nextTime, ok = actionTime, true
+		}
+		if actionTime, ok2 := midiOutQueue.NextActionTime(); ok2 && (!ok || actionTime.Before(nextTime)) {
+			nextTime, ok = actionTime, true
+		}
+		if !ok {
+			break
+		}
+		clock.AdvanceTo(nextTime)
+	}
+	return timeline, nil
+}
+
+// runOneDryRunStep does what one of the processing goroutines would do next.
+// It returns false if there is nothing to do at the current virtual time.
+func (app *application) runOneDryRunStep(clock *virtualClock, keystrokeQueue, midiOutQueue *virtualActionQueue) bool {
+	select {
+	case r := <-app.MidiRealtimeGoro:
+		cgc.RunOneRequest(app.ctx, r)
+		return true
+	case r := <-app.MidiPlaybackGoro:
+		cgc.RunOneRequest(app.ctx, r)
+		return true
+	case r := <-app.KeystrokeGoro:
+		cgc.RunOneRequest(app.ctx, r)
+		return true
+	default:
+	}
+	now := clock.Now()
+	if nextAction := midiOutQueue.PopAction(now); nextAction != nil {
+		// There is no MIDI output device during a dry run.
+		return true
+	}
+	if nextAction := keystrokeQueue.PopAction(now); nextAction != nil {
+		app.produceKeystroke(nextAction.Value.(*midiQueueEvent))
+		return true
+	}
+	select {
+	case now := <-app.keyStatus.clearModifiersTimer.C():
+		app.clearModifiers(now)
+		return true
+	case now := <-app.keyStatus.chord.timer.C():
+		app.resolveChord(now)
+		return true
+	case now := <-app.keyStatus.watchdog.timer.C():
+		app.runKeyWatchdog(now)
+		return true
+	case now := <-app.midiFileBuffer.nextEventTimer.C():
+		app.playNextMidiEvent(now)
+		return true
+	default:
+	}
+	return false
+}
+
+func (t *dryRunTimeline) SendKeys(pInputs []keyInput) error {
+	now := t.app.clock.Now()
+	for _, input := range pInputs {
+		entry := dryRunEntry{
+			Time:  t.relativeTime(now),
+			Event: "press",
+			Key:   keyName(input.VirtualKeyCode),
+		}
+		switch {
+		case input.KeyUp:
+			entry.Event = "release"
+		case input.VirtualKeyCode != vkControl && input.VirtualKeyCode != vkMenu && input.VirtualKeyCode != vkShift && t.app.keyStatus.pressedKeys[input.VirtualKeyCode].Pressed:
+			// The key status is updated before keys are sent,
+			// octave shift keys are never marked as pressed
+			entry.Note, _ = noteIndexToName(t.app.keyStatus.pressedKeys[input.VirtualKeyCode].MidiNote)
+		}
+		t.Entries = append(t.Entries, entry)
+	}
+	return nil
+}
+
+func (t *dryRunTimeline) addTraceEvent(event *keystrokeTraceEvent) {
+	entry := dryRunEntry{
+		Time:   t.relativeTime(event.Time),
+		Event:  "delay",
+		Delay:  float64(event.Delay/time.Nanosecond) * 1e-9,
+		Reason: event.Reason,
+	}
+	if event.Dropped {
+		entry.Event = "drop"
+	}
+	entry.Note = noteDisplayName(event.Note)
+	t.Entries = append(t.Entries, entry)
+}
+
+func (t *dryRunTimeline) relativeTime(now time.Time) float64 {
+	return float64(now.Sub(t.startTime)/time.Nanosecond) * 1e-9
+}
+
+func (t *dryRunTimeline) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"time", "event", "key", "note", "delay", "reason"})
+	if err != nil {
+		return err
+	}
+	for _, entry := range t.Entries {
+		delay := ""
+		if entry.Delay != 0 {
+			delay = strconv.FormatFloat(entry.Delay, 'f', 3, 64)
+		}
+		err = writer.Write([]string{
+			strconv.FormatFloat(entry.Time, 'f', 3, 64),
+			entry.Event,
+			entry.Key,
+			entry.Note,
+			delay,
+			entry.Reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func keyName(virtualKeyCode uint8) string {
+	switch {
+	case virtualKeyCode == vkControl:
+		return "Ctrl"
+	case virtualKeyCode == vkMenu:
+		return "Alt"
+	case virtualKeyCode == vkShift:
+		return "Shift"
+	case virtualKeyCode >= '0' && virtualKeyCode <= '9', virtualKeyCode >= 'A' && virtualKeyCode <= 'Z':
+		return fmt.Sprintf("'%c'", virtualKeyCode)
+	default:
+		return fmt.Sprintf("0x%02x", virtualKeyCode)
+	}
+}
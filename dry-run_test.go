@@ -0,0 +1,287 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/m13253/midimark"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// testMidiEvent is a message at an absolute tick, there are 480 ticks to a
+// quarter note.
+type testMidiEvent struct {
+	Tick    uint32
+	Message []byte
+}
+
+// encodeTestMidiFile builds a Standard MIDI File out of the tracks. Unless a
+// track sets the tempo, it is 120 BPM, i.e. 1 second is 960 ticks.
+func encodeTestMidiFile(format uint16, tracks ...[]testMidiEvent) []byte {
+	var file bytes.Buffer
+	file.WriteString("MThd")
+	binary.Write(&file, binary.BigEndian, []uint32{6})
+	binary.Write(&file, binary.BigEndian, []uint16{format, uint16(len(tracks)), 480})
+	for _, events := range tracks {
+		var track bytes.Buffer
+		lastTick := uint32(0)
+		for _, event := range append(events, testMidiEvent{lastTick, []byte{0xff, 0x2f, 0x00}}) {
+			if event.Tick < lastTick {
+				event.Tick = lastTick
+			}
+			delta := event.Tick - lastTick
+			lastTick = event.Tick
+			vlq := []byte{byte(delta & 0x7f)}
+			for delta >>= 7; delta != 0; delta >>= 7 {
+				vlq = append([]byte{byte(delta&0x7f) | 0x80}, vlq...)
+			}
+			track.Write(vlq)
+			track.Write(event.Message)
+		}
+		file.WriteString("MTrk")
+		binary.Write(&file, binary.BigEndian, []uint32{uint32(track.Len())})
+		track.WriteTo(&file)
+	}
+	return file.Bytes()
+}
+
+// decodeTestMidiFile decodes the file built by encodeTestMidiFile.
+func decodeTestMidiFile(t *testing.T, format uint16, tracks ...[]testMidiEvent) *midimark.Sequence {
+	t.Helper()
+	sequence, err := midimark.DecodeSequenceFromSMF(bytes.NewReader(encodeTestMidiFile(format, tracks...)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sequence
+}
+
+// dryRunCSV renders the first track of the sequence, and returns the lines
+// of the timeline without the header.
+func dryRunCSV(t *testing.T, p preset, sequence *midimark.Sequence) []string {
+	t.Helper()
+	app := &application{
+		preset: p,
+		ctx:    context.Background(),
+	}
+	track := uint16(1)
+	if len(sequence.Tracks) == 1 {
+		track = 0
+	}
+	timeline, err := app.dryRunMidiPlayback(sequence, &dryRunOptions{
+		Tracks:         []uint16{track},
+		Channels:       allMidiChannels,
+		ChannelRouting: p.MidiChannel,
+		Keybinding:     p.Keybinding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var csv bytes.Buffer
+	err = timeline.writeCSV(&csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(csv.String(), "\n"), "\n")[1:]
+}
+
+type demoPart struct {
+	File      string
+	Track     uint16
+	Transpose int
+}
+
+// readDemoParts lists the parts documented in demo/README.txt.
+func readDemoParts(t *testing.T) []demoPart {
+	f, err := os.Open(filepath.Join("demo", "README.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	parts := []demoPart{}
+	file := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# ") {
+			file = strings.TrimPrefix(line, "# ")
+			continue
+		}
+		// Part 1:    Transpose +12, recommended: Flute
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) < 4 || fields[0] != "Part" || fields[2] != "Transpose" {
+			continue
+		}
+		track, err := strconv.ParseUint(strings.TrimSuffix(fields[1], ":"), 10, 16)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		transpose, err := strconv.ParseInt(fields[3], 10, 8)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		parts = append(parts, demoPart{
+			File:      file,
+			Track:     uint16(track),
+			Transpose: int(transpose),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return parts
+}
+
+func TestDemoGolden(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	app := &application{
+		preset: defaultPreset,
+		ctx:    context.Background(),
+	}
+	parts := readDemoParts(t)
+	if len(parts) == 0 {
+		t.Fatal("no parts found in demo/README.txt")
+	}
+	for _, part := range parts {
+		part := part
+		name := fmt.Sprintf("%s.part%d", strings.TrimSuffix(part.File, ".mid"), part.Track)
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("demo", part.File))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sequence, err := midimark.DecodeSequenceFromSMF(f, nil)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			timeline, err := app.dryRunMidiPlayback(sequence, &dryRunOptions{
+				Tracks:         []uint16{part.Track},
+				Channels:       allMidiChannels,
+				Transpose:      part.Transpose,
+				ChannelRouting: app.MidiChannel,
+				Keybinding:     app.Keybinding,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			err = timeline.writeCSV(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			goldenFile := filepath.Join("testdata", "golden", name+".csv")
+			if *updateGolden {
+				err = ioutil.WriteFile(goldenFile, got.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("%v (run \"go test -run TestDemoGolden -update\" to create it)", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				gotLines := strings.Split(got.String(), "\n")
+				wantLines := strings.Split(string(want), "\n")
+				for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+					var gotLine, wantLine string
+					if i < len(gotLines) {
+						gotLine = gotLines[i]
+					}
+					if i < len(wantLines) {
+						wantLine = wantLines[i]
+					}
+					if gotLine != wantLine {
+						t.Fatalf("%s differs at line %d:\n got: %s\nwant: %s", goldenFile, i+1, gotLine, wantLine)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDryRunSpeed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	app := &application{
+		preset: defaultPreset,
+		ctx:    context.Background(),
+	}
+	f, err := os.Open(filepath.Join("demo", "Bach Prelude.mid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence, err := midimark.DecodeSequenceFromSMF(f, nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastPress := func(speed float64) float64 {
+		timeline, err := app.dryRunMidiPlayback(sequence, &dryRunOptions{
+			Tracks:         []uint16{1},
+			Channels:       allMidiChannels,
+			Speed:          speed,
+			ChannelRouting: app.MidiChannel,
+			Keybinding:     app.Keybinding,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := 0.0
+		for _, entry := range timeline.Entries {
+			if entry.Event == "press" {
+				last = entry.Time
+			}
+		}
+		return last
+	}
+	normal := lastPress(1)
+	// Faster speeds are not tested, SkillCooldown may hold notes back
+	for _, speed := range []float64{0.5, 0.75} {
+		got, want := lastPress(speed), normal/speed
+		if math.Abs(got-want) > 0.1 {
+			t.Errorf("last key press at speed %g: got %.3f s, want %.3f s", speed, got, want)
+		}
+	}
+}
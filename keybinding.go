@@ -0,0 +1,188 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// setKeybinding changes the key of one note while playing. The key is
+// released first if it is pressed for this note.
+func (app *application) setKeybinding(note uint8, keybind keybindingPreset) {
+	pInputs := app.releaseNote([]keyInput{}, int(note), app.clock.Now())
+	if len(pInputs) != 0 {
+		app.sendKeys(pInputs)
+	}
+	app.keyStatus.keybinding[note] = keybind
+	if app.keyStatus.keybindingProfile == "default" {
+		app.keyStatus.defaultKeybinding[note] = keybind
+	}
+}
+
+// setDefaultKeybindings replaces the keybindings of profile "default". They
+// take effect at once if it is in use, or when it is switched back to.
+func (app *application) setDefaultKeybindings(keybindings *[128]keybindingPreset) {
+	if app.keyStatus.keybindingProfile != "default" {
+		app.keyStatus.defaultKeybinding = *keybindings
+		return
+	}
+	for note, keybind := range keybindings {
+		if keybind != app.keyStatus.keybinding[note] {
+			app.setKeybinding(uint8(note), keybind)
+		}
+	}
+}
+
+// setKeybindingProfile switches all keybindings at once. Pressed keys are
+// released first.
+func (app *application) setKeybindingProfile(name string) error {
+	if app.KeybindingMode != "modifier" {
+		return fmt.Errorf("keybinding profiles are not supported in octave mode")
+	}
+	profile := app.findKeybindingProfile(name)
+	if profile == nil {
+		return fmt.Errorf("unknown keybinding profile %q", name)
+	}
+	pInputs := []keyInput{}
+	now := app.clock.Now()
+	for note := range app.keyStatus.keybinding {
+		pInputs = app.releaseNote(pInputs, note, now)
+	}
+	if len(pInputs) != 0 {
+		app.sendKeys(pInputs)
+	}
+	app.keyStatus.sustainedNotes = [128]bool{}
+	if name == "default" {
+		app.keyStatus.keybinding = app.keyStatus.defaultKeybinding
+	} else {
+		app.keyStatus.keybinding = profile.Keybinding
+	}
+	app.keyStatus.keybindingProfile = name
+	log.Printf("Keybinding profile changed to %s.\n", name)
+	return nil
+}
+
+// startMidiLearn makes the next note-on from the MIDI input device be
+// captured instead of played, so the web console can bind a key to it.
+func (app *application) startMidiLearn() {
+	app.MidiLearnActive = true
+	app.MidiLearnNote = -1
+}
+
+func (app *application) stopMidiLearn() {
+	app.MidiLearnActive = false
+}
+
+// captureMidiLearn returns true if the note is captured. The note is after
+// channel and split zone transpose, as the keybinding sees it.
+func (app *application) captureMidiLearn(event *midiQueueEvent, note int) bool {
+	if !app.MidiLearnActive || !event.Realtime || event.Message[2] == 0 || event.Message[2] < app.MinTriggerVelocity || note < 0x00 || note > 0x7f {
+		return false
+	}
+	app.MidiLearnActive = false
+	app.MidiLearnNote = note
+	return true
+}
+
+// formatConfigKeybinding writes a Keybinding line in the format of
+// midi2ffxiv.conf.
+func formatConfigKeybinding(note uint8, keybind keybindingPreset) string {
+	noteName, _ := noteIndexToName(note)
+	line := fmt.Sprintf("%-16s%-8s", "Keybinding", noteName)
+	modifiers := 0
+	if keybind.Ctrl {
+		line += fmt.Sprintf("%-8s", "Ctrl")
+		modifiers++
+	}
+	if keybind.Alt {
+		line += fmt.Sprintf("%-8s", "Alt")
+		modifiers++
+	}
+	if keybind.Shift {
+		line += fmt.Sprintf("%-8s", "Shift")
+		modifiers++
+	}
+	if modifiers == 0 {
+		line += strings.Repeat(" ", 8)
+	}
+	return line + keyName(keybind.VirtualKeyCode)
+}
+
+// saveKeybindings updates the Keybinding lines in the config file. Lines of
+// unchanged keybindings are kept as they are, together with the comments
+// around them. New keybindings are added after the last Keybinding line.
+// A note without key is written as 0x00 if it has a key by default.
+func (app *application) saveKeybindings(keybindings *[128]keybindingPreset) error {
+	config, err := ioutil.ReadFile(app.ConfigFile)
+	if err != nil {
+		return err
+	}
+	eol := "\n"
+	if bytes.Contains(config, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	lines := strings.Split(strings.TrimSuffix(string(config), eol), eol)
+	output := make([]string, 0, len(lines))
+	var written [128]bool
+	insertAt := len(lines)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Keybinding" {
+			output = append(output, line)
+			continue
+		}
+		var existing [128]keybindingPreset
+		if app.parseConfigKeybindings(fields, &existing) != nil {
+			output = append(output, line)
+			continue
+		}
+		note, _ := noteNameToIndex(fields[1])
+		insertAt = len(output)
+		if written[note] || (keybindings[note].VirtualKeyCode == 0 && defaultPreset.Keybinding[note].VirtualKeyCode == 0) {
+			continue
+		}
+		if existing[note] == keybindings[note] {
+			output = append(output, line)
+		} else {
+			output = append(output, formatConfigKeybinding(note, keybindings[note]))
+		}
+		written[note] = true
+		insertAt = len(output)
+	}
+	newLines := []string{}
+	for i := range keybindings {
+		if !written[i] && keybindings[i] != defaultPreset.Keybinding[i] {
+			newLines = append(newLines, formatConfigKeybinding(uint8(i), keybindings[i]))
+		}
+	}
+	if insertAt > len(output) {
+		insertAt = len(output)
+	}
+	output = append(output[:insertAt], append(newLines, output[insertAt:]...)...)
+	return ioutil.WriteFile(app.ConfigFile, []byte(strings.Join(output, eol)+eol), 0644)
+}
@@ -0,0 +1,153 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveKeybindings(t *testing.T) {
+	for _, name := range []string{"midi2ffxiv.conf", "midi2ffxiv_no_modifier.conf"} {
+		original, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configFile := filepath.Join(t.TempDir(), name)
+		err = ioutil.WriteFile(configFile, original, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		load := func() *application {
+			t.Helper()
+			app := &application{preset: defaultPreset}
+			app.ConfigFile = configFile
+			f, err := os.Open(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			err = app.parseConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return app
+		}
+
+		app := load()
+		keybindings := app.Keybinding
+		keybindings[0x3c] = keybindingPreset{VirtualKeyCode: 'A', Alt: true}
+		keybindings[0x3e] = keybindingPreset{}
+		keybindings[0x24] = keybindingPreset{VirtualKeyCode: 'Z', Ctrl: true, Shift: true}
+		err = app.saveKeybindings(&keybindings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reloaded := load(); reloaded.Keybinding != keybindings {
+			t.Errorf("%s: reloaded keybindings differ from the saved ones", name)
+			for note := range keybindings {
+				if reloaded.Keybinding[note] != keybindings[note] {
+					t.Errorf("%s: note %#02x got %+v, want %+v", name, note, reloaded.Keybinding[note], keybindings[note])
+				}
+			}
+		}
+
+		// Everything but the Keybinding lines is kept, line endings included
+		saved, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherLines := func(config []byte) []string {
+			lines := []string{}
+			for _, line := range strings.SplitAfter(string(config), "\n") {
+				if fields := strings.Fields(line); len(fields) == 0 || fields[0] != "Keybinding" {
+					lines = append(lines, line)
+				}
+			}
+			return lines
+		}
+		want, got := otherLines(original), otherLines(saved)
+		if strings.Join(got, "") != strings.Join(want, "") {
+			t.Errorf("%s: other lines changed:\n got: %q\nwant: %q", name, got, want)
+		}
+
+		// Saving the same keybindings again changes nothing
+		err = app.saveKeybindings(&keybindings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(saved) {
+			t.Errorf("%s: saving twice changed the file", name)
+		}
+	}
+}
+
+func TestMidiLearn(t *testing.T) {
+	p := defaultPreset
+	p.MidiChannel[1] = midiChannelRoute{Mode: "on", Transpose: 12}
+	s := newSimulation(t, p)
+
+	// Note-offs and note-ons with velocity 0 are not captured
+	s.app.startMidiLearn()
+	s.send(0x80, 0x3c, 0x00)
+	s.send(0x90, 0x3c, 0x00)
+	s.run(10 * time.Millisecond)
+	if !s.app.MidiLearnActive || s.app.MidiLearnNote != -1 {
+		t.Fatalf("captured a note-off: active %v note %d", s.app.MidiLearnActive, s.app.MidiLearnNote)
+	}
+
+	// The note is captured after channel transpose, and not played
+	s.send(0x91, 0x3c, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t)
+	if s.app.MidiLearnActive || s.app.MidiLearnNote != 0x48 {
+		t.Fatalf("got active %v note %#02x, want note 0x48", s.app.MidiLearnActive, s.app.MidiLearnNote)
+	}
+
+	// Only the first one
+	s.send(0x81, 0x3c, 0x00)
+	s.send(0x90, 0x3e, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'W'")
+	if s.app.MidiLearnNote != 0x48 {
+		t.Fatalf("got note %#02x, want 0x48", s.app.MidiLearnNote)
+	}
+
+	// Learning can be cancelled
+	s.app.startMidiLearn()
+	s.app.stopMidiLearn()
+	s.send(0x80, 0x3e, 0x00)
+	s.send(0x90, 0x40, 0x40)
+	s.run(200 * time.Millisecond)
+	s.expectKeys(t, "-'W'", "+'E'")
+}
@@ -0,0 +1,253 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var chordPolicies = []string{"latest", "highest", "lowest", "first", "arpeggio-up", "arpeggio-down"}
+
+func isChordPolicy(policy string) bool {
+	for _, i := range chordPolicies {
+		if policy == i {
+			return true
+		}
+	}
+	return false
+}
+
+// chordStatus collects the note-on events that arrive within ChordWindow,
+// so ChordPolicy can decide which of them are played on the monophonic
+// instrument. Each split zone collects its chords separately.
+type chordStatus struct {
+	groups []*chordGroup
+	timer  clockTimer
+	// The generation the scheduled notes belong to, see
+	// application.midiGeneration
+	generation uint32
+}
+
+// chordGroup is the chord being collected in one split zone.
+//
+// Notes are counted in scheduled from the moment they are chosen until they
+// are played. A note-off for a pending or scheduled note is held back in
+// deferredOff, and sent after the note is played.
+type chordGroup struct {
+	zone        int
+	notes       []*midiQueueEvent
+	open        bool
+	start       time.Time
+	scheduled   [128]int
+	deferredOff [128]bool
+}
+
+func (app *application) initChord() {
+	app.keyStatus.chord.timer = app.clock.NewTimer(app.ChordWindow)
+	app.keyStatus.chord.timer.Stop()
+	app.keyStatus.chord.generation = atomic.LoadUint32(&app.midiGeneration)
+}
+
+func (app *application) chordPolicy(event *midiQueueEvent) string {
+	if event.ChordPolicy != "" {
+		return event.ChordPolicy
+	}
+	return app.ChordPolicy
+}
+
+func (chord *chordStatus) group(zone int) *chordGroup {
+	for _, i := range chord.groups {
+		if i.zone == zone {
+			return i
+		}
+	}
+	group := &chordGroup{zone: zone}
+	chord.groups = append(chord.groups, group)
+	return group
+}
+
+// addChordNote returns true if the note is to be played right now.
+func (app *application) addChordNote(event *midiQueueEvent, now time.Time) bool {
+	chord := &app.keyStatus.chord
+	group := chord.group(event.Zone)
+	if app.chordPolicy(event) == "first" {
+		// Measured with the event time, since the cooldowns of the first
+		// note may have delayed the others
+		eventTime := event.Time
+		if eventTime.IsZero() {
+			eventTime = now
+		}
+		if group.open && eventTime.Sub(group.start) < app.ChordWindow {
+			app.traceDroppedNote(now, event.keyNote(), "chord policy")
+			return false
+		}
+		group.open = true
+		group.start = eventTime
+		group.scheduled[event.Message[1]]++
+		return true
+	}
+	if len(group.notes) == 0 {
+		group.open = true
+		group.start = now
+	}
+	group.notes = append(group.notes, event)
+	app.resetChordTimer(now)
+	return false
+}
+
+// resetChordTimer sets the timer to the earliest window that is still open.
+func (app *application) resetChordTimer(now time.Time) {
+	chord := &app.keyStatus.chord
+	chord.timer.Stop()
+	var start time.Time
+	for _, group := range chord.groups {
+		if len(group.notes) != 0 && (start.IsZero() || group.start.Before(start)) {
+			start = group.start
+		}
+	}
+	if !start.IsZero() {
+		chord.timer.Reset(start.Add(app.ChordWindow).Sub(now))
+	}
+}
+
+func (app *application) resolveChord(now time.Time) {
+	chord := &app.keyStatus.chord
+	for _, group := range chord.groups {
+		if len(group.notes) != 0 && !now.Before(group.start.Add(app.ChordWindow)) {
+			app.resolveChordGroup(group, now)
+		}
+	}
+	app.resetChordTimer(now)
+}
+
+func (app *application) resolveChordGroup(group *chordGroup, now time.Time) {
+	group.open = false
+	notes := group.notes
+	group.notes = nil
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].Message[1] < notes[j].Message[1]
+	})
+	var played, dropped []*midiQueueEvent
+	switch app.chordPolicy(notes[0]) {
+	case "highest":
+		played, dropped = notes[len(notes)-1:], notes[:len(notes)-1]
+	case "lowest":
+		played, dropped = notes[:1], notes[1:]
+	case "arpeggio-up":
+		played = notes
+	case "arpeggio-down":
+		for i := len(notes) - 1; i >= 0; i-- {
+			played = append(played, notes[i])
+		}
+	}
+	for _, event := range dropped {
+		note := event.Message[1]
+		if group.scheduled[note] == 0 {
+			group.deferredOff[note] = false
+		}
+		app.traceDroppedNote(now, event.keyNote(), "chord policy")
+	}
+	for i, event := range played {
+		delay := time.Duration(i) * app.SkillCooldown
+		resolved := *event
+		resolved.Time = now.Add(delay)
+		if !event.Expiry.IsZero() {
+			resolved.Expiry = event.Expiry.Add(resolved.Time.Sub(event.Time))
+		}
+		resolved.ChordResolved = true
+		group.scheduled[event.Message[1]]++
+		if delay != 0 {
+			app.traceDelayedNote(now, event.keyNote(), delay, "arpeggio")
+		}
+		app.keystrokeQueue.AddAction(&resolved, resolved.Time)
+	}
+}
+
+// deferChordNoteOff returns true if the note-off has to wait until the note
+// is played.
+func (app *application) deferChordNoteOff(event *midiQueueEvent) bool {
+	group := app.keyStatus.chord.group(event.Zone)
+	note := event.Message[1]
+	pending := group.scheduled[note] != 0
+	for _, i := range group.notes {
+		if i.Message[1] == note {
+			pending = true
+		}
+	}
+	if pending {
+		group.deferredOff[note] = true
+	}
+	return pending
+}
+
+// finishChordNote is called when a scheduled note is played or skipped.
+func (app *application) finishChordNote(event *midiQueueEvent) {
+	chord := &app.keyStatus.chord
+	group := chord.group(event.Zone)
+	note := event.Message[1]
+	// Forgotten by resetChord after an emergency stop
+	if event.Generation != chord.generation || group.scheduled[note] == 0 {
+		return
+	}
+	group.scheduled[note]--
+	if group.scheduled[note] == 0 && group.deferredOff[note] {
+		group.deferredOff[note] = false
+		app.keystrokeQueue.AddAction(&midiQueueEvent{
+			Message:           []byte{0x80, note, 0x00},
+			Realtime:          event.Realtime,
+			AlreadyTransposed: true,
+			Transpose:         event.Transpose,
+			OutOfRangePolicy:  event.OutOfRangePolicy,
+			ChordResolved:     true,
+			Zone:              event.Zone,
+			ChordPolicy:       event.ChordPolicy,
+			NoteOverflow:      event.NoteOverflow,
+			Generation:        event.Generation,
+		}, time.Time{})
+	}
+}
+
+// resetChord forgets the pending notes. The scheduled ones are still in the
+// queue, unless an emergency stop has discarded them.
+func (app *application) resetChord() {
+	chord := &app.keyStatus.chord
+	chord.timer.Stop()
+	generation := atomic.LoadUint32(&app.midiGeneration)
+	discarded := generation != chord.generation
+	chord.generation = generation
+	for _, group := range chord.groups {
+		group.notes = nil
+		group.open = false
+		if discarded {
+			group.scheduled = [128]int{}
+		}
+		for i := range group.deferredOff {
+			if group.scheduled[i] == 0 {
+				group.deferredOff[i] = false
+			}
+		}
+	}
+}
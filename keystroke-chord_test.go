@@ -0,0 +1,220 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChordPolicies(t *testing.T) {
+	// A C major chord for a second, then D4
+	sequence := decodeTestMidiFile(t, 0, []testMidiEvent{
+		{0, []byte{0x90, 0x3c, 0x40}},
+		{0, []byte{0x90, 0x40, 0x40}},
+		{0, []byte{0x90, 0x43, 0x40}},
+		{960, []byte{0x80, 0x3c, 0x00}},
+		{960, []byte{0x80, 0x40, 0x00}},
+		{960, []byte{0x80, 0x43, 0x00}},
+		{1920, []byte{0x90, 0x3e, 0x40}},
+		{2400, []byte{0x80, 0x3e, 0x00}},
+	})
+	for _, test := range []struct {
+		policy string
+		want   []string
+	}{
+		{"latest", []string{
+			"-0.050,delay,,C4,0.050,modifier cooldown",
+			"0.000,press,'Q',C4,,",
+			"0.000,delay,,E4,0.050,modifier cooldown",
+			"0.050,delay,,E4,0.075,skill cooldown",
+			"0.125,press,'E',E4,,",
+			"0.125,delay,,G4,0.050,modifier cooldown",
+			"0.175,delay,,G4,0.075,skill cooldown",
+			"0.250,press,'T',G4,,",
+			"1.075,release,'Q',,,",
+			"1.075,release,'E',,,",
+			"1.075,release,'T',,,",
+			"1.950,delay,,D4,0.050,modifier cooldown",
+			"2.000,press,'W',D4,,",
+			"2.500,release,'W',,,",
+		}},
+		{"highest", []string{
+			"-0.020,drop,,C4,,chord policy",
+			"-0.020,drop,,E4,,chord policy",
+			"-0.020,delay,,G4,0.050,modifier cooldown",
+			"0.030,press,'T',G4,,",
+			"0.950,release,'T',,,",
+			"1.980,delay,,D4,0.050,modifier cooldown",
+			"2.030,press,'W',D4,,",
+			"2.450,release,'W',,,",
+		}},
+		{"lowest", []string{
+			"-0.020,drop,,E4,,chord policy",
+			"-0.020,drop,,G4,,chord policy",
+			"-0.020,delay,,C4,0.050,modifier cooldown",
+			"0.030,press,'Q',C4,,",
+			"0.950,release,'Q',,,",
+			"1.980,delay,,D4,0.050,modifier cooldown",
+			"2.030,press,'W',D4,,",
+			"2.450,release,'W',,,",
+		}},
+		{"first", []string{
+			"-0.050,delay,,C4,0.050,modifier cooldown",
+			"0.000,press,'Q',C4,,",
+			"0.000,drop,,E4,,chord policy",
+			"0.000,drop,,G4,,chord policy",
+			"0.950,release,'Q',,,",
+			"1.950,delay,,D4,0.050,modifier cooldown",
+			"2.000,press,'W',D4,,",
+			"2.500,release,'W',,,",
+		}},
+		{"arpeggio-up", []string{
+			"-0.020,delay,,E4,0.125,arpeggio",
+			"-0.020,delay,,G4,0.250,arpeggio",
+			"-0.020,delay,,C4,0.050,modifier cooldown",
+			"0.030,press,'Q',C4,,",
+			"0.105,delay,,E4,0.050,modifier cooldown",
+			"0.155,press,'E',E4,,",
+			"0.230,delay,,G4,0.050,modifier cooldown",
+			"0.280,press,'T',G4,,",
+			"0.950,release,'Q',,,",
+			"0.950,release,'E',,,",
+			"0.950,release,'T',,,",
+			"1.980,delay,,D4,0.050,modifier cooldown",
+			"2.030,press,'W',D4,,",
+			"2.450,release,'W',,,",
+		}},
+		{"arpeggio-down", []string{
+			"-0.020,delay,,E4,0.125,arpeggio",
+			"-0.020,delay,,C4,0.250,arpeggio",
+			"-0.020,delay,,G4,0.050,modifier cooldown",
+			"0.030,press,'T',G4,,",
+			"0.105,delay,,E4,0.050,modifier cooldown",
+			"0.155,press,'E',E4,,",
+			"0.230,delay,,C4,0.050,modifier cooldown",
+			"0.280,press,'Q',C4,,",
+			"0.950,release,'Q',,,",
+			"0.950,release,'E',,,",
+			"0.950,release,'T',,,",
+			"1.980,delay,,D4,0.050,modifier cooldown",
+			"2.030,press,'W',D4,,",
+			"2.450,release,'W',,,",
+		}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			p := defaultPreset
+			p.ChordPolicy = test.policy
+			got := dryRunCSV(t, p, sequence)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// Notes from different split zones may be transposed to the same note, but
+// their note-offs must not be mixed up.
+func TestChordPolicyPerZone(t *testing.T) {
+	p := defaultPreset
+	p.SplitZone = []splitZone{
+		{Low: 0, High: 59, Transpose: 12, ChordPolicy: "arpeggio-up"},
+		{Low: 60, High: 127, ChordPolicy: "first"},
+	}
+	s := newSimulation(t, p)
+
+	// C4 E4 G4 in the lower zone, arpeggiated after ChordWindow
+	s.send(0x90, 0x30, 0x40)
+	s.send(0x90, 0x34, 0x40)
+	s.send(0x90, 0x37, 0x40)
+	s.run(10 * time.Millisecond)
+	// E4 tapped in the upper zone, before E4 of the arpeggio
+	s.send(0x90, 0x40, 0x40)
+	s.run(10 * time.Millisecond)
+	s.send(0x80, 0x40, 0x00)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "+'E'", "-'E'", "+'Q'")
+
+	// E4 of the arpeggio is held until its own note-off
+	s.run(500 * time.Millisecond)
+	s.expectKeys(t, "+'E'", "+'T'")
+	s.send(0x80, 0x30, 0x00)
+	s.send(0x80, 0x34, 0x00)
+	s.send(0x80, 0x37, 0x00)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "-'Q'", "-'E'", "-'T'")
+}
+
+// An emergency stop discards the rest of an arpeggio, its notes must not
+// hold back later note-offs.
+func TestChordEmergencyStop(t *testing.T) {
+	p := defaultPreset
+	p.ChordPolicy = "arpeggio-up"
+	s := newSimulation(t, p)
+
+	s.send(0x90, 0x3c, 0x40)
+	s.send(0x90, 0x40, 0x40)
+	s.send(0x90, 0x43, 0x40)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "+'Q'")
+	s.app.emergencyStop()
+	s.run(time.Second)
+	s.expectKeys(t, "-'Q'")
+
+	s.send(0x90, 0x43, 0x40)
+	s.run(100 * time.Millisecond)
+	s.send(0x80, 0x43, 0x00)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "+'T'", "-'T'")
+}
+
+// A note of the chord dropped for being late must not hold back its
+// note-off either.
+func TestChordLateNoteDropped(t *testing.T) {
+	p := defaultPreset
+	p.ChordPolicy = "arpeggio-up"
+	p.LateNotePolicy = "drop"
+	p.RealtimeMaxLatency = 5 * time.Millisecond
+	s := newSimulation(t, p)
+
+	s.send(0x90, 0x3c, 0x40)
+	s.send(0x90, 0x40, 0x40)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "+'Q'")
+	// The keystroke goroutine stalls, E4 expires in the queue
+	s.clock.AdvanceTo(s.clock.Now().Add(time.Second))
+	s.run(100 * time.Millisecond)
+	s.send(0x80, 0x3c, 0x00)
+	s.send(0x80, 0x40, 0x00)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "-'Q'")
+
+	s.send(0x90, 0x40, 0x40)
+	s.run(100 * time.Millisecond)
+	s.send(0x80, 0x40, 0x00)
+	s.run(100 * time.Millisecond)
+	s.expectKeys(t, "+'E'", "-'E'")
+}
@@ -0,0 +1,221 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var lateNotePolicies = []string{"drop", "play", "catch-up"}
+
+// lateNoteStatus keeps the rhythm in the "catch-up" late-note policy.
+// When a note is played late, the following notes are shifted by lag, and
+// the rests between them are shortened until lag is back to zero.
+type lateNoteStatus struct {
+	lag      time.Duration
+	lastTime time.Time
+}
+
+// noteStatistics counts what happened to the notes since the program
+// started, or since it was last reset on the web console.
+// It is safe for concurrent use. A nil *noteStatistics counts nothing.
+type noteStatistics struct {
+	mutex       sync.Mutex
+	since       time.Time
+	played      uint64
+	late        uint64
+	maxLateness time.Duration
+	dropped     map[string]uint64
+	delayed     map[string]*delayStatistics
+}
+
+type delayStatistics struct {
+	Count uint64        `json:"count"`
+	Total time.Duration `json:"-"`
+	// Total in seconds, filled in by snapshot
+	TotalSeconds float64 `json:"total"`
+}
+
+// noteStatisticsSnapshot is a copy of noteStatistics.
+type noteStatisticsSnapshot struct {
+	Since       time.Time
+	Played      uint64
+	Late        uint64
+	MaxLateness time.Duration
+	Dropped     map[string]uint64
+	Delayed     map[string]delayStatistics
+}
+
+func newNoteStatistics(now time.Time) *noteStatistics {
+	s := new(noteStatistics)
+	s.reset(now)
+	return s
+}
+
+func (s *noteStatistics) reset(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.since = now
+	s.played = 0
+	s.late = 0
+	s.maxLateness = 0
+	s.dropped = make(map[string]uint64)
+	s.delayed = make(map[string]*delayStatistics)
+}
+
+func (s *noteStatistics) addPlayed() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.played++
+}
+
+func (s *noteStatistics) addLate(lateness time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.late++
+	if lateness > s.maxLateness {
+		s.maxLateness = lateness
+	}
+}
+
+func (s *noteStatistics) addDropped(reason string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropped[reason]++
+}
+
+func (s *noteStatistics) addDelayed(reason string, delay time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.delayed[reason]
+	if stats == nil {
+		stats = new(delayStatistics)
+		s.delayed[reason] = stats
+	}
+	stats.Count++
+	stats.Total += delay
+}
+
+func (s *noteStatistics) snapshot() (snapshot noteStatisticsSnapshot) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot = noteStatisticsSnapshot{
+		Since:       s.since,
+		Played:      s.played,
+		Late:        s.late,
+		MaxLateness: s.maxLateness,
+		Dropped:     make(map[string]uint64, len(s.dropped)),
+		Delayed:     make(map[string]delayStatistics, len(s.delayed)),
+	}
+	for reason, count := range s.dropped {
+		snapshot.Dropped[reason] = count
+	}
+	for reason, stats := range s.delayed {
+		delayed := *stats
+		delayed.TotalSeconds = float64(delayed.Total/time.Nanosecond) * 1e-9
+		snapshot.Delayed[reason] = delayed
+	}
+	return
+}
+
+// isLateNote tells if the note is being played after its expiry, which is
+// RealtimeMaxLatency or PlaybackMaxLatency after it was due.
+func isLateNote(event *midiQueueEvent, now time.Time) bool {
+	return !event.Expiry.IsZero() && now.After(event.Expiry)
+}
+
+// catchUpNote waits until the note is due after the lag of earlier late notes.
+func (app *application) catchUpNote(event *midiQueueEvent, now time.Time) time.Time {
+	status := &app.keyStatus.lateNotes[0]
+	if event.Realtime {
+		status = &app.keyStatus.lateNotes[1]
+	}
+	// Note-offs are shifted by the lag left at their time as well
+	lag := status.lag
+	if !status.lastTime.IsZero() {
+		if rest := event.Time.Sub(status.lastTime) - app.SkillCooldown; rest > 0 {
+			if rest > lag {
+				rest = lag
+			}
+			lag -= rest
+		}
+	}
+	if event.Message[0] == 0x90 {
+		status.lag = lag
+		status.lastTime = event.Time
+	}
+	if event.Time.IsZero() || lag == 0 {
+		return now
+	}
+	if waitTime := event.Time.Add(lag).Sub(now); waitTime > 0 {
+		if event.Message[0] == 0x90 {
+			app.traceDelayedNote(now, event.keyNote(), waitTime, "catch-up")
+		}
+		if waitTime < time.Millisecond {
+			waitTime = 0
+		}
+		app.clock.Sleep(waitTime)
+		now = now.Add(waitTime)
+	}
+	return now
+}
+
+// finishLateNote records a note played late. In the "catch-up" policy, the
+// following notes are shifted by its lateness.
+func (app *application) finishLateNote(event *midiQueueEvent, now time.Time) {
+	status := &app.keyStatus.lateNotes[0]
+	if event.Realtime {
+		status = &app.keyStatus.lateNotes[1]
+	}
+	lag := time.Duration(0)
+	if app.LateNotePolicy == "catch-up" {
+		lag = status.lag
+	}
+	if event.Expiry.IsZero() || !now.After(event.Expiry.Add(lag)) {
+		return
+	}
+	app.statistics.addLate(now.Sub(event.Time.Add(lag)))
+	if app.LateNotePolicy == "catch-up" {
+		status.lag = now.Sub(event.Time)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLateNotePolicies(t *testing.T) {
+	// A chord takes longer than PlaybackMaxLatency to play, then D4
+	sequence := decodeTestMidiFile(t, 0, []testMidiEvent{
+		{0, []byte{0x90, 0x3c, 0x40}},
+		{0, []byte{0x90, 0x40, 0x40}},
+		{0, []byte{0x90, 0x43, 0x40}},
+		{0, []byte{0x90, 0x47, 0x40}},
+		{240, []byte{0x80, 0x3c, 0x00}},
+		{240, []byte{0x80, 0x40, 0x00}},
+		{240, []byte{0x80, 0x43, 0x00}},
+		{240, []byte{0x80, 0x47, 0x00}},
+		{240, []byte{0x90, 0x3e, 0x40}},
+		{480, []byte{0x80, 0x3e, 0x00}},
+		{960, []byte{0x90, 0x41, 0x40}},
+		{1200, []byte{0x80, 0x41, 0x00}},
+	})
+	for _, test := range []struct {
+		policy string
+		want   []string
+	}{
+		{"drop", []string{
+			"-0.050,delay,,C4,0.050,modifier cooldown",
+			"0.000,press,'Q',C4,,",
+			"0.000,delay,,E4,0.050,modifier cooldown",
+			"0.050,delay,,E4,0.075,skill cooldown",
+			"0.125,drop,,E4,,expired",
+			"0.125,drop,,G4,,expired in queue",
+			"0.125,drop,,B4,,expired in queue",
+			"0.200,release,'Q',,,",
+			"0.200,delay,,D4,0.050,modifier cooldown",
+			"0.250,press,'W',D4,,",
+			"0.500,release,'W',,,",
+			"0.950,delay,,F4,0.050,modifier cooldown",
+			"1.000,press,'R',F4,,",
+			"1.250,release,'R',,,",
+		}},
+		{"play", []string{
+			"-0.050,delay,,C4,0.050,modifier cooldown",
+			"0.000,press,'Q',C4,,",
+			"0.000,delay,,E4,0.050,modifier cooldown",
+			"0.050,delay,,E4,0.075,skill cooldown",
+			"0.125,press,'E',E4,,",
+			"0.125,delay,,G4,0.050,modifier cooldown",
+			"0.175,delay,,G4,0.075,skill cooldown",
+			"0.250,press,'T',G4,,",
+			"0.250,delay,,B4,0.050,modifier cooldown",
+			"0.300,delay,,B4,0.075,skill cooldown",
+			"0.375,press,'U',B4,,",
+			"0.375,release,'Q',,,",
+			"0.375,release,'E',,,",
+			"0.375,release,'T',,,",
+			"0.375,release,'U',,,",
+			"0.375,delay,,D4,0.050,modifier cooldown",
+			"0.425,delay,,D4,0.075,skill cooldown",
+			"0.500,press,'W',D4,,",
+			"0.575,release,'W',,,",
+			"0.950,delay,,F4,0.050,modifier cooldown",
+			"1.000,press,'R',F4,,",
+			"1.250,release,'R',,,",
+		}},
+		// The notes after B4 are shifted by its lateness, until the rest
+		// before F4 takes it up
+		{"catch-up", []string{
+			"-0.050,delay,,C4,0.050,modifier cooldown",
+			"0.000,press,'Q',C4,,",
+			"0.000,delay,,E4,0.050,modifier cooldown",
+			"0.050,delay,,E4,0.075,skill cooldown",
+			"0.125,press,'E',E4,,",
+			"0.125,delay,,G4,0.050,modifier cooldown",
+			"0.175,delay,,G4,0.075,skill cooldown",
+			"0.250,press,'T',G4,,",
+			"0.250,delay,,B4,0.050,modifier cooldown",
+			"0.300,delay,,B4,0.075,skill cooldown",
+			"0.375,press,'U',B4,,",
+			"0.500,release,'Q',,,",
+			"0.500,release,'E',,,",
+			"0.500,release,'T',,,",
+			"0.500,release,'U',,,",
+			"0.500,delay,,D4,0.050,modifier cooldown",
+			"0.550,press,'W',D4,,",
+			"0.625,release,'W',,,",
+			"1.025,delay,,F4,0.050,modifier cooldown",
+			"1.075,press,'R',F4,,",
+			"1.250,release,'R',,,",
+		}},
+	} {
+		p := defaultPreset
+		p.LateNotePolicy = test.policy
+		p.PlaybackMaxLatency = 100 * time.Millisecond
+		got := dryRunCSV(t, p, sequence)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got: %s\nwant: %s", test.policy, strings.Join(got, "\n      "), strings.Join(test.want, "\n      "))
+		}
+	}
+}
+
+func TestLateNoteStatistics(t *testing.T) {
+	type delayed struct {
+		Count uint64  `json:"count"`
+		Total float64 `json:"total"`
+	}
+	type statistics struct {
+		Since          float64            `json:"since"`
+		LateNotePolicy string             `json:"late_note_policy"`
+		Played         uint64             `json:"played"`
+		Late           uint64             `json:"late"`
+		MaxLateness    float64            `json:"max_lateness"`
+		Dropped        map[string]uint64  `json:"dropped"`
+		Delayed        map[string]delayed `json:"delayed"`
+	}
+	for _, test := range []struct {
+		policy string
+		want   statistics
+	}{
+		{"drop", statistics{0, "drop", 2, 0, 0, map[string]uint64{"expired": 1, "expired in queue": 2}, map[string]delayed{"skill cooldown": {1, 0.125}}}},
+		{"play", statistics{0, "play", 5, 3, 0.375, map[string]uint64{}, map[string]delayed{"skill cooldown": {3, 0.375}}}},
+		// Only the first late note counts its whole lateness
+		{"catch-up", statistics{0, "catch-up", 5, 3, 0.125, map[string]uint64{}, map[string]delayed{"skill cooldown": {3, 0.375}}}},
+	} {
+		s := newSimulation(t, defaultPreset)
+		s.app.LateNotePolicy = test.policy
+		s.app.RealtimeMaxLatency = 100 * time.Millisecond
+		h := s.app.newWebHandlers()
+
+		// A chord takes longer than RealtimeMaxLatency to play
+		for _, note := range []uint8{0x3c, 0x40, 0x43, 0x47} {
+			s.send(0x90, note, 0x40)
+		}
+		s.run(time.Second)
+		for _, note := range []uint8{0x3c, 0x40, 0x43, 0x47} {
+			s.send(0x80, note, 0x00)
+		}
+		s.send(0x90, 0x3e, 0x40)
+		s.run(time.Second)
+
+		var got statistics
+		webRequest(t, h, "GET", "/statistics", "", &got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got: %+v\nwant: %+v", test.policy, got, test.want)
+		}
+		var reset statistics
+		webRequest(t, h, "DELETE", "/statistics", "", &reset)
+		if want := (statistics{2, test.policy, 0, 0, 0, map[string]uint64{}, map[string]delayed{}}); !reflect.DeepEqual(reset, want) {
+			t.Errorf("%s after DELETE:\n got: %+v\nwant: %+v", test.policy, reset, want)
+		}
+	}
+}
+
+// A note dropped after waiting for the skill cooldown has already released
+// the previous key and switched the modifiers, which must reach the game.
+func TestLateNoteDropSendsModifiers(t *testing.T) {
+	p := defaultPreset
+	p.LateNotePolicy = "drop"
+	p.RealtimeMaxLatency = 5 * time.Millisecond
+	s := newSimulation(t, p)
+
+	s.send(0x90, 0x48, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+Shift", "+'Q'")
+	s.send(0x90, 0x30, 0x40)
+	s.run(500 * time.Millisecond)
+	s.expectKeys(t, "-'Q'", "+Ctrl", "-Shift")
+	s.send(0x80, 0x48, 0x00)
+	s.send(0x80, 0x30, 0x00)
+	s.run(2 * time.Second)
+	s.expectKeys(t, "-Ctrl")
+}
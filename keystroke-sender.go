@@ -0,0 +1,64 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+const (
+	vkShift   uint8 = 0x10
+	vkControl uint8 = 0x11
+	vkMenu    uint8 = 0x12
+)
+
+// keyInput is a single press or release of a virtual key.
+//
+// Modifiers (Ctrl, Alt, Shift) are sent as ordinary virtual keys.
+type keyInput struct {
+	VirtualKeyCode uint8
+	KeyUp          bool
+}
+
+// keySender delivers keystrokes produced by the keystroke goroutine.
+//
+// All inputs passed in one call should be delivered in order as a single
+// batch, so that modifier changes and key presses stay together.
+type keySender interface {
+	SendKeys(pInputs []keyInput) error
+}
+
+// nullKeySender discards every keystroke, it is used when there is no way to
+// inject keystrokes on this platform.
+type nullKeySender struct{}
+
+func (s nullKeySender) SendKeys(pInputs []keyInput) error {
+	return nil
+}
+
+// recordingKeySender keeps every keystroke in memory instead of sending it.
+type recordingKeySender struct {
+	Inputs []keyInput
+}
+
+func (s *recordingKeySender) SendKeys(pInputs []keyInput) error {
+	s.Inputs = append(s.Inputs, pInputs...)
+	return nil
+}
@@ -0,0 +1,55 @@
+// +build windows
+
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"github.com/m13253/midi2ffxiv/user32"
+)
+
+// sendInputKeySender injects keystrokes into the system with SendInput.
+type sendInputKeySender struct{}
+
+func (s sendInputKeySender) SendKeys(pInputs []keyInput) error {
+	inputs := make([]user32.INPUT_KEYBDINPUT, len(pInputs))
+	for i, input := range pInputs {
+		dwFlags := user32.KEYEVENTF_SCANCODE
+		if input.KeyUp {
+			dwFlags |= user32.KEYEVENTF_KEYUP
+		}
+		inputs[i] = user32.INPUT_KEYBDINPUT{
+			Type: user32.INPUT_KEYBOARD,
+			Ki: user32.KEYBDINPUT{
+				WVk:         0,
+				WScan:       uint16(user32.MapVirtualKey(uint32(input.VirtualKeyCode), user32.MAPVK_VK_TO_VSC)),
+				DwFlags:     dwFlags,
+				Time:        0,
+				DwExtraInfo: 0,
+			},
+		}
+	}
+	_, err := user32.SendInput(inputs)
+	return err
+}
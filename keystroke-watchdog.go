@@ -0,0 +1,147 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+
+	cgc "github.com/m13253/cgc-go"
+)
+
+// runKeystrokeStep handles one event on KeystrokeGoro. It returns false when
+// the program is quitting.
+//
+// If anything panics, every key is released before going on, so no key is
+// left pressed in the game.
+func (app *application) runKeystrokeStep() (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Error: %v\n%s", err, debug.Stack())
+			app.releaseAllKeys(app.clock.Now())
+			ok = true
+		}
+	}()
+	select {
+	case r, ok := <-app.KeystrokeGoro:
+		if !ok {
+			return false
+		}
+		cgc.RunOneRequest(app.ctx, r)
+	case nextAction := <-app.keystrokeQueue.NextAction():
+		nextEvent := nextAction.Value.(*midiQueueEvent)
+		app.produceKeystroke(nextEvent)
+	case now := <-app.keyStatus.clearModifiersTimer.C():
+		app.clearModifiers(now)
+	case now := <-app.keyStatus.chord.timer.C():
+		app.resolveChord(now)
+	case now := <-app.keyStatus.watchdog.timer.C():
+		app.runKeyWatchdog(now)
+	case <-app.ctx.Done():
+		return false
+	}
+	return true
+}
+
+// releaseAllKeys sends key-ups for every pressed key and modifier, and
+// forgets the sustain pedal, the sustained and pending chord notes.
+func (app *application) releaseAllKeys(now time.Time) {
+	pInputs := []keyInput{}
+	for i := range app.keyStatus.pressedKeys {
+		if app.keyStatus.pressedKeys[i].Pressed {
+			pInputs = append(pInputs, keyInput{VirtualKeyCode: uint8(i), KeyUp: true})
+			app.keyStatus.pressedKeys[i].Pressed = false
+			app.keyStatus.pressedKeys[i].LastChange = now
+			app.keyStatus.pressedKeys[i].LastRelease = now
+		}
+	}
+	app.keyStatus.pressedKeysCount = 0
+	app.keyStatus.sustain = false
+	app.keyStatus.sustainedNotes = [128]bool{}
+	app.keyStatus.lateNotes = [2]lateNoteStatus{}
+	app.resetChord()
+	if len(pInputs) != 0 {
+		app.sendKeys(pInputs)
+	}
+	app.clearModifiers(now)
+	app.keyStatus.clearModifiersTimer.Stop()
+	app.keyStatus.watchdog.timer.Stop()
+	app.keyStatus.watchdog.armed = false
+}
+
+// keyWatchdog releases the keys held longer than MaxKeyHold.
+type keyWatchdog struct {
+	timer clockTimer
+	armed bool
+}
+
+func (app *application) initKeyWatchdog() {
+	app.keyStatus.watchdog.timer = app.clock.NewTimer(app.MaxKeyHold)
+	app.keyStatus.watchdog.timer.Stop()
+}
+
+func (app *application) armKeyWatchdog() {
+	if app.MaxKeyHold == 0 || app.keyStatus.watchdog.armed {
+		return
+	}
+	app.keyStatus.watchdog.timer.Reset(app.MaxKeyHold)
+	app.keyStatus.watchdog.armed = true
+}
+
+func (app *application) runKeyWatchdog(now time.Time) {
+	app.keyStatus.watchdog.armed = false
+	pInputs := []keyInput{}
+	var nextCheck time.Duration
+	for i := range app.keyStatus.pressedKeys {
+		key := &app.keyStatus.pressedKeys[i]
+		if !key.Pressed {
+			continue
+		}
+		held := now.Sub(key.LastPress)
+		if held < app.MaxKeyHold {
+			if nextCheck == 0 || app.MaxKeyHold-held < nextCheck {
+				nextCheck = app.MaxKeyHold - held
+			}
+			continue
+		}
+		log.Printf("Key %s held for %s, releasing.\n", keyName(uint8(i)), held)
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: uint8(i), KeyUp: true})
+		key.Pressed = false
+		key.LastChange = now
+		key.LastRelease = now
+		app.keyStatus.pressedKeysCount--
+		app.keyStatus.sustainedNotes[key.MidiNote] = false
+	}
+	if len(pInputs) != 0 {
+		if app.keyStatus.pressedKeysCount == 0 {
+			app.keyStatus.clearModifiersTimer.Reset(app.IdleDuration)
+		}
+		app.sendKeys(pInputs)
+	}
+	if nextCheck != 0 {
+		app.keyStatus.watchdog.timer.Reset(nextCheck)
+		app.keyStatus.watchdog.armed = true
+	}
+}
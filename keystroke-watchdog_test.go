@@ -0,0 +1,80 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyWatchdog(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+
+	// The note-offs are lost
+	s.send(0x90, 0x3c, 0x40)
+	s.run(5 * time.Second)
+	s.send(0x90, 0x40, 0x40)
+	s.run(time.Second)
+	s.expectKeys(t, "+'Q'", "+'E'")
+	s.run(defaultPreset.MaxKeyHold - 6*time.Second - time.Millisecond)
+	s.expectKeys(t)
+	s.run(time.Millisecond)
+	s.expectKeys(t, "-'Q'")
+	s.run(5 * time.Second)
+	s.expectKeys(t, "-'E'")
+
+	// Released keys are not released again
+	s.send(0x80, 0x3c, 0x00)
+	s.send(0x80, 0x40, 0x00)
+	s.run(defaultPreset.MaxKeyHold)
+	s.expectKeys(t)
+
+	// Keys released in time are not touched
+	s.send(0x90, 0x3c, 0x40)
+	s.run(time.Second)
+	s.send(0x80, 0x3c, 0x00)
+	s.run(defaultPreset.MaxKeyHold)
+	s.expectKeys(t, "+'Q'", "-'Q'")
+}
+
+func TestKeystrokeStepPanic(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+	s.send(0x90, 0x48, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+Shift", "+'Q'")
+
+	_ = s.app.KeystrokeGoro.SubmitNoWait(s.app.ctx, func(context.Context) (interface{}, error) {
+		panic("test")
+	})
+	if !s.app.runKeystrokeStep() {
+		t.Fatal("runKeystrokeStep returned false after a panic")
+	}
+	s.expectKeys(t, "-'Q'", "-Shift")
+
+	// Playing goes on
+	s.send(0x90, 0x48, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+Shift", "+'Q'")
+}
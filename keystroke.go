@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -28,10 +26,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"time"
-
-	"github.com/m13253/midi2ffxiv/user32"
-	cgc "github.com/m13253/cgc-go"
 )
 
 type keystroke struct {
@@ -43,6 +39,9 @@ type keystroke struct {
 }
 
 type keystrokeStatus struct {
+	keybinding          [128]keybindingPreset
+	keybindingProfile   string
+	defaultKeybinding   [128]keybindingPreset // Kept up to date while another profile is in use
 	pressedKeys         [256]keystroke
 	pressedKeysCount    int
 	ctrl                keystroke
@@ -51,116 +50,119 @@ type keystrokeStatus struct {
 	lastNote            uint8
 	lastNoteTime        time.Time
 	lastModifierTime    time.Time
-	clearModifiersTimer *time.Timer
+	octave              int8
+	sustain             bool
+	sustainedNotes      [128]bool
+	clearModifiersTimer clockTimer
+	chord               chordStatus
+	lateNotes           [2]lateNoteStatus
+	watchdog            keyWatchdog
+}
+
+// keystrokeTraceEvent tells why a note was dropped or delayed.
+// It is only collected when app.keystrokeTrace is set, e.g. during a dry run.
+type keystrokeTraceEvent struct {
+	Time    time.Time
+	Note    int
+	Dropped bool
+	Delay   time.Duration
+	Reason  string
 }
 
 func (app *application) processKeystrokes() {
+	defer close(app.keystrokeStopped)
+	app.initKeystrokes()
+	for app.runKeystrokeStep() {
+	}
+	log.Println("Releasing all keys.")
+	app.releaseAllKeys(app.clock.Now())
+}
+
+func (app *application) initKeystrokes() {
 	app.keyStatus = &keystrokeStatus{
-		clearModifiersTimer: time.NewTimer(app.IdleDuration),
+		keybinding:          app.Keybinding,
+		keybindingProfile:   "default",
+		defaultKeybinding:   app.Keybinding,
+		clearModifiersTimer: app.clock.NewTimer(app.IdleDuration),
 		lastNote:            0xff,
 	}
-	for {
-		select {
-		case r, ok := <-app.KeystrokeGoro:
-			if !ok {
-				return
-			}
-			cgc.RunOneRequest(app.ctx, r)
-		case nextAction := <-app.keystrokeQueue.NextAction():
-			nextEvent := nextAction.Value.(*midiQueueEvent)
-			app.produceKeystroke(nextEvent)
-		case now := <-app.keyStatus.clearModifiersTimer.C:
-			app.clearModifiers(now)
-		case <-app.ctx.Done():
-			return
-		}
-	}
+	app.initChord()
+	app.initKeyWatchdog()
 }
 
 func (app *application) produceKeystroke(event *midiQueueEvent) {
-	pInputs := []user32.INPUT_KEYBDINPUT{}
-	now := time.Now()
+	if app.isStaleMidiEvent(event) {
+		if event.Message[0] == 0x90 && event.ChordResolved {
+			app.finishChordNote(event)
+		}
+		return
+	}
+	pInputs := []keyInput{}
+	now := app.clock.Now()
+	if event.Muted {
+		if event.Realtime {
+			app.midiOutQueue.AddAction(event, now.Add(app.RealtimeExtraDelay))
+		} else {
+			app.midiOutQueue.AddAction(event, now.Add(app.PlaybackExtraDelay))
+		}
+		return
+	}
+	if app.LateNotePolicy == "catch-up" && (event.Message[0] == 0x80 || event.Message[0] == 0x90) {
+		now = app.catchUpNote(event, now)
+	}
 	if event.Message[0] == 0x80 {
+		if app.chordPolicy(event) != "latest" && app.deferChordNoteOff(event) {
+			return
+		}
 		if event.Realtime {
 			app.midiOutQueue.AddAction(event, now)
 		} else {
 			app.midiOutQueue.AddAction(event, now.Add(app.PlaybackExtraDelay))
 		}
-		note := int(event.Message[1])
-		if event.AlreadyTransposed {
-			note -= app.MidiOutTranspose
-			if note < 0x00 || note > 0x7f {
-				return
-			}
-		}
-		keybind := &app.Keybinding[note]
-		if keybind.VirtualKeyCode == 0 {
+		note, reason := app.resolveNoteRange(event.keyNote(), app.outOfRangePolicy(event))
+		if reason != "" {
 			return
 		}
-		if app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed && app.keyStatus.pressedKeys[keybind.VirtualKeyCode].MidiNote == uint8(note) {
-			pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-				Type: user32.INPUT_KEYBOARD,
-				Ki: user32.KEYBDINPUT{
-					WVk:         0,
-					WScan:       uint16(user32.MapVirtualKey(uint32(keybind.VirtualKeyCode), user32.MAPVK_VK_TO_VSC)),
-					DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-					Time:        0,
-					DwExtraInfo: 0,
-				},
-			})
-			app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed = false
-			app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastRelease = now
-			app.keyStatus.pressedKeysCount--
-		}
-		if app.keyStatus.pressedKeysCount == 0 {
-			app.keyStatus.clearModifiersTimer.Reset(app.IdleDuration)
+		if event.Realtime && app.keyStatus.sustain {
+			app.keyStatus.sustainedNotes[note] = true
+			return
 		}
+		pInputs = app.releaseNote(pInputs, note, now)
 	} else if event.Message[0] == 0x90 {
-		app.keyStatus.clearModifiersTimer.Stop()
-		note := int(event.Message[1])
-		if event.AlreadyTransposed {
-			note -= app.MidiOutTranspose
-			if note < 0x00 || note > 0x7f {
+		if app.chordPolicy(event) != "latest" {
+			if !event.ChordResolved && !app.addChordNote(event, now) {
 				return
 			}
+			defer app.finishChordNote(event)
 		}
-		keybind := &app.Keybinding[note]
-		if keybind.VirtualKeyCode == 0 {
-			noteName, _ := noteIndexToName(uint8(note))
-			log.Printf("Note %s out of range.\n", noteName)
+		if app.LateNotePolicy == "drop" && isLateNote(event, now) {
+			app.traceDroppedNote(now, event.keyNote(), "expired in queue")
 			return
 		}
+		// The game plays one note at a time, a new note ends the sustained ones
+		pInputs = app.releaseSustainedNotes(pInputs, now)
+		app.keyStatus.clearModifiersTimer.Stop()
+		note := event.keyNote()
+		resolvedNote, reason := app.resolveNoteRange(note, app.outOfRangePolicy(event))
+		if reason != "" {
+			log.Printf("Note %s out of range.\n", noteDisplayName(note))
+			app.traceDroppedNote(now, note, reason)
+			return
+		}
+		if resolvedNote != note {
+			log.Printf("Note %s out of range, playing %s instead.\n", noteDisplayName(note), noteDisplayName(resolvedNote))
+			note = resolvedNote
+		}
+		keybind := &app.keyStatus.keybinding[note]
 		if app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed {
-			pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-				Type: user32.INPUT_KEYBOARD,
-				Ki: user32.KEYBDINPUT{
-					WVk:         0,
-					WScan:       uint16(user32.MapVirtualKey(uint32(keybind.VirtualKeyCode), user32.MAPVK_VK_TO_VSC)),
-					DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-					Time:        0,
-					DwExtraInfo: 0,
-				},
-			})
+			pInputs = append(pInputs, keyInput{VirtualKeyCode: keybind.VirtualKeyCode, KeyUp: true})
 			app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed = false
 			app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastChange = now
 			app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastRelease = now
 			app.keyStatus.pressedKeysCount--
 		}
 		if app.keyStatus.ctrl.Pressed != keybind.Ctrl {
-			dwFlags := user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP
-			if keybind.Ctrl {
-				dwFlags = user32.KEYEVENTF_SCANCODE
-			}
-			pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-				Type: user32.INPUT_KEYBOARD,
-				Ki: user32.KEYBDINPUT{
-					WVk:         0,
-					WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_CONTROL), user32.MAPVK_VK_TO_VSC)),
-					DwFlags:     dwFlags,
-					Time:        0,
-					DwExtraInfo: 0,
-				},
-			})
+			pInputs = append(pInputs, keyInput{VirtualKeyCode: vkControl, KeyUp: !keybind.Ctrl})
 			if keybind.Ctrl {
 				app.keyStatus.ctrl.Pressed = true
 				app.keyStatus.ctrl.LastChange = now
@@ -173,20 +175,7 @@ func (app *application) produceKeystroke(event *midiQueueEvent) {
 			app.keyStatus.lastModifierTime = now
 		}
 		if app.keyStatus.alt.Pressed != keybind.Alt {
-			dwFlags := user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP
-			if keybind.Alt {
-				dwFlags = user32.KEYEVENTF_SCANCODE
-			}
-			pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-				Type: user32.INPUT_KEYBOARD,
-				Ki: user32.KEYBDINPUT{
-					WVk:         0,
-					WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_MENU), user32.MAPVK_VK_TO_VSC)),
-					DwFlags:     dwFlags,
-					Time:        0,
-					DwExtraInfo: 0,
-				},
-			})
+			pInputs = append(pInputs, keyInput{VirtualKeyCode: vkMenu, KeyUp: !keybind.Alt})
 			if keybind.Alt {
 				app.keyStatus.alt.Pressed = true
 				app.keyStatus.alt.LastChange = now
@@ -199,20 +188,7 @@ func (app *application) produceKeystroke(event *midiQueueEvent) {
 			app.keyStatus.lastModifierTime = now
 		}
 		if app.keyStatus.shift.Pressed != keybind.Shift {
-			dwFlags := user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP
-			if keybind.Shift {
-				dwFlags = user32.KEYEVENTF_SCANCODE
-			}
-			pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-				Type: user32.INPUT_KEYBOARD,
-				Ki: user32.KEYBDINPUT{
-					WVk:         0,
-					WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_SHIFT), user32.MAPVK_VK_TO_VSC)),
-					DwFlags:     dwFlags,
-					Time:        0,
-					DwExtraInfo: 0,
-				},
-			})
+			pInputs = append(pInputs, keyInput{VirtualKeyCode: vkShift, KeyUp: !keybind.Shift})
 			if keybind.Shift {
 				app.keyStatus.shift.Pressed = true
 				app.keyStatus.shift.LastChange = now
@@ -224,35 +200,41 @@ func (app *application) produceKeystroke(event *midiQueueEvent) {
 			}
 			app.keyStatus.lastModifierTime = now
 		}
+		if app.KeybindingMode == "octave" {
+			pInputs = app.shiftOctave(pInputs, app.octaveShift[note], now)
+		}
 		if !event.Realtime && app.ModifierCooldown != 0 {
 			if len(pInputs) != 0 {
-				_, err := user32.SendInput(pInputs)
-				if err != nil {
-					log.Println("Error: ", err)
-				}
-				app.printPressedKeys()
-				pInputs = []user32.INPUT_KEYBDINPUT{}
+				app.sendKeys(pInputs)
+				pInputs = []keyInput{}
 			}
 			waitTime := app.ModifierCooldown
 			if waitTime != 0 {
 				log.Printf("Modifier cooldown (playback) %s.\n", waitTime)
+				app.traceDelayedNote(now, note, waitTime, "modifier cooldown")
 				if waitTime < time.Millisecond {
 					waitTime = 0
 				}
-				time.Sleep(waitTime)
+				app.clock.Sleep(waitTime)
 				now = now.Add(waitTime)
 			}
 		}
 		if !app.keyStatus.lastNoteTime.IsZero() && ((event.Message[0] == 0x80 && app.keyStatus.lastNote == uint8(note)) || event.Message[0] == 0x90) && now.Sub(app.keyStatus.lastNoteTime) < app.SkillCooldown {
 			waitTime := app.keyStatus.lastNoteTime.Add(app.SkillCooldown).Sub(now)
 			log.Printf("Skill cooldown sleep %s.\n", waitTime)
+			app.traceDelayedNote(now, note, waitTime, "skill cooldown")
 			if waitTime < time.Millisecond {
 				waitTime = 0
 			}
-			time.Sleep(waitTime)
+			app.clock.Sleep(waitTime)
 			now = now.Add(waitTime)
 		}
-		if !event.Expiry.IsZero() && now.After(event.Expiry) {
+		if app.LateNotePolicy == "drop" && isLateNote(event, now) {
+			app.traceDroppedNote(now, note, "expired")
+			// The keys and modifiers already switched are still sent
+			if len(pInputs) != 0 {
+				app.sendKeys(pInputs)
+			}
 			return
 		}
 		if event.Realtime {
@@ -262,64 +244,47 @@ func (app *application) produceKeystroke(event *midiQueueEvent) {
 		}
 		if event.Realtime && !app.keyStatus.lastModifierTime.IsZero() && now.Sub(app.keyStatus.lastModifierTime) < app.ModifierCooldown {
 			if len(pInputs) != 0 {
-				_, err := user32.SendInput(pInputs)
-				if err != nil {
-					log.Println("Error: ", err)
-				}
-				app.printPressedKeys()
-				pInputs = []user32.INPUT_KEYBDINPUT{}
+				app.sendKeys(pInputs)
+				pInputs = []keyInput{}
 			}
 			waitTime := app.keyStatus.lastModifierTime.Add(app.ModifierCooldown).Sub(now)
 			log.Printf("Modifier cooldown (realtime) %s.\n", waitTime)
+			app.traceDelayedNote(now, note, waitTime, "modifier cooldown")
 			if waitTime < time.Millisecond {
 				waitTime = 0
 			}
-			time.Sleep(waitTime)
+			app.clock.Sleep(waitTime)
 			now = now.Add(waitTime)
 		}
 		app.keyStatus.lastNote = uint8(note)
 		app.keyStatus.lastNoteTime = now
-		pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-			Type: user32.INPUT_KEYBOARD,
-			Ki: user32.KEYBDINPUT{
-				WVk:         0,
-				WScan:       uint16(user32.MapVirtualKey(uint32(keybind.VirtualKeyCode), user32.MAPVK_VK_TO_VSC)),
-				DwFlags:     user32.KEYEVENTF_SCANCODE,
-				Time:        0,
-				DwExtraInfo: 0,
-			},
-		})
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: keybind.VirtualKeyCode})
 		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed = true
 		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].MidiNote = uint8(note)
 		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastChange = now
 		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastPress = now
 		app.keyStatus.pressedKeysCount++
+		app.armKeyWatchdog()
+		app.statistics.addPlayed()
+		app.finishLateNote(event, now)
 	} else if event.Message[0] == 0xb0 {
 		if event.Realtime {
 			app.midiOutQueue.AddAction(event, now)
 		} else {
 			app.midiOutQueue.AddAction(event, now.Add(app.PlaybackExtraDelay))
 		}
+		if len(event.Message) > 2 && event.Message[1] == 0x40 && event.Realtime {
+			app.keyStatus.sustain = event.Message[2] >= 0x40
+			if !app.keyStatus.sustain {
+				pInputs = app.releaseSustainedNotes(pInputs, now)
+			}
+		}
 		if len(event.Message) > 1 && event.Message[1] == 0x7b {
-			for i := 0; i < 256; i++ {
-				if app.keyStatus.pressedKeys[i].Pressed {
-					pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-						Type: user32.INPUT_KEYBOARD,
-						Ki: user32.KEYBDINPUT{
-							WVk:         0,
-							WScan:       uint16(user32.MapVirtualKey(uint32(i), user32.MAPVK_VK_TO_VSC)),
-							DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-							Time:        0,
-							DwExtraInfo: 0,
-						},
-					})
-					app.keyStatus.pressedKeys[i].Pressed = false
-					app.keyStatus.pressedKeys[i].LastChange = now
-					app.keyStatus.pressedKeys[i].LastRelease = now
-					app.keyStatus.pressedKeysCount--
-				}
+			if len(pInputs) != 0 {
+				app.sendKeys(pInputs)
+				pInputs = []keyInput{}
 			}
-			app.keyStatus.clearModifiersTimer.Reset(0)
+			app.releaseAllKeys(now)
 		}
 	} else {
 		if event.Realtime {
@@ -329,71 +294,198 @@ func (app *application) produceKeystroke(event *midiQueueEvent) {
 		}
 	}
 	if len(pInputs) != 0 {
-		_, err := user32.SendInput(pInputs)
-		if err != nil {
-			log.Println("Error: ", err)
+		app.sendKeys(pInputs)
+	}
+}
+
+// keyNote returns the note to be played in the game, which may be out of
+// 0 - 127 until resolveNoteRange is called.
+func (event *midiQueueEvent) keyNote() int {
+	note := int(event.Message[1]) + event.NoteOverflow
+	if event.AlreadyTransposed {
+		note -= event.Transpose
+	}
+	return note
+}
+
+// noteDisplayName returns the name of the note, or its number if it is out
+// of 0 - 127.
+func noteDisplayName(note int) string {
+	if note < 0x00 || note > 0x7f {
+		return strconv.Itoa(note)
+	}
+	noteName, _ := noteIndexToName(uint8(note))
+	return noteName
+}
+
+// releaseNote releases the key of note, unless the key has since been pressed
+// for another note.
+func (app *application) releaseNote(pInputs []keyInput, note int, now time.Time) []keyInput {
+	keybind := &app.keyStatus.keybinding[note]
+	if app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed && app.keyStatus.pressedKeys[keybind.VirtualKeyCode].MidiNote == uint8(note) {
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: keybind.VirtualKeyCode, KeyUp: true})
+		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].Pressed = false
+		app.keyStatus.pressedKeys[keybind.VirtualKeyCode].LastRelease = now
+		app.keyStatus.pressedKeysCount--
+	}
+	if app.keyStatus.pressedKeysCount == 0 {
+		app.keyStatus.clearModifiersTimer.Reset(app.IdleDuration)
+	}
+	return pInputs
+}
+
+// releaseSustainedNotes releases the notes whose note-off was held back by
+// the sustain pedal (CC64).
+func (app *application) releaseSustainedNotes(pInputs []keyInput, now time.Time) []keyInput {
+	for note, sustained := range app.keyStatus.sustainedNotes {
+		if sustained {
+			app.keyStatus.sustainedNotes[note] = false
+			pInputs = app.releaseNote(pInputs, note, now)
+		}
+	}
+	return pInputs
+}
+
+var outOfRangePolicies = []string{"drop", "fold", "clamp"}
+
+func isOutOfRangePolicy(policy string) bool {
+	for _, i := range outOfRangePolicies {
+		if policy == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *application) outOfRangePolicy(event *midiQueueEvent) string {
+	if event.OutOfRangePolicy != "" {
+		return event.OutOfRangePolicy
+	}
+	return app.OutOfRangePolicy
+}
+
+// resolveNoteRange finds the note to play instead of a note without
+// keybinding. It returns a reason if the note has to be dropped.
+func (app *application) resolveNoteRange(note int, policy string) (int, string) {
+	if note >= 0x00 && note <= 0x7f && app.keyStatus.keybinding[note].VirtualKeyCode != 0 {
+		return note, ""
+	}
+	reason := "no keybinding"
+	if note < 0x00 || note > 0x7f {
+		reason = "transposed out of range"
+	}
+	lowest, highest := -1, -1
+	for i := range app.keyStatus.keybinding {
+		if app.keyStatus.keybinding[i].VirtualKeyCode != 0 {
+			if lowest < 0 {
+				lowest = i
+			}
+			highest = i
 		}
-		app.printPressedKeys()
 	}
+	if lowest < 0 {
+		return note, reason
+	}
+	resolvedNote := note
+	switch policy {
+	case "fold":
+		if note < lowest {
+			resolvedNote = note + (lowest-note+11)/12*12
+		} else if note > highest {
+			resolvedNote = note - (note-highest+11)/12*12
+		}
+	case "clamp":
+		if note < lowest {
+			resolvedNote = lowest
+		} else if note > highest {
+			resolvedNote = highest
+		}
+	}
+	// A gap in the keybinding cannot be helped
+	if resolvedNote < lowest || resolvedNote > highest || app.keyStatus.keybinding[resolvedNote].VirtualKeyCode == 0 {
+		return note, reason
+	}
+	return resolvedNote, ""
 }
 
 func (app *application) clearModifiers(now time.Time) {
-	pInputs := []user32.INPUT_KEYBDINPUT{}
+	pInputs := []keyInput{}
 	if app.keyStatus.ctrl.Pressed {
-		pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-			Type: user32.INPUT_KEYBOARD,
-			Ki: user32.KEYBDINPUT{
-				WVk:         0,
-				WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_CONTROL), user32.MAPVK_VK_TO_VSC)),
-				DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-				Time:        0,
-				DwExtraInfo: 0,
-			},
-		})
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: vkControl, KeyUp: true})
 		app.keyStatus.ctrl.Pressed = false
 		app.keyStatus.ctrl.LastChange = now
 		app.keyStatus.ctrl.LastRelease = now
 		app.keyStatus.lastModifierTime = now
 	}
 	if app.keyStatus.alt.Pressed {
-		pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-			Type: user32.INPUT_KEYBOARD,
-			Ki: user32.KEYBDINPUT{
-				WVk:         0,
-				WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_MENU), user32.MAPVK_VK_TO_VSC)),
-				DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-				Time:        0,
-				DwExtraInfo: 0,
-			},
-		})
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: vkMenu, KeyUp: true})
 		app.keyStatus.alt.Pressed = false
 		app.keyStatus.alt.LastChange = now
 		app.keyStatus.alt.LastRelease = now
 		app.keyStatus.lastModifierTime = now
 	}
 	if app.keyStatus.shift.Pressed {
-		pInputs = append(pInputs, user32.INPUT_KEYBDINPUT{
-			Type: user32.INPUT_KEYBOARD,
-			Ki: user32.KEYBDINPUT{
-				WVk:         0,
-				WScan:       uint16(user32.MapVirtualKey(uint32(user32.VK_SHIFT), user32.MAPVK_VK_TO_VSC)),
-				DwFlags:     user32.KEYEVENTF_SCANCODE | user32.KEYEVENTF_KEYUP,
-				Time:        0,
-				DwExtraInfo: 0,
-			},
-		})
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: vkShift, KeyUp: true})
 		app.keyStatus.shift.Pressed = false
 		app.keyStatus.shift.LastChange = now
 		app.keyStatus.shift.LastRelease = now
 		app.keyStatus.lastModifierTime = now
 	}
+	if app.KeybindingMode == "octave" {
+		pInputs = app.shiftOctave(pInputs, 0, now)
+	}
 	if len(pInputs) != 0 {
-		_, err := user32.SendInput(pInputs)
-		if err != nil {
-			log.Println("Error: ", err)
+		app.sendKeys(pInputs)
+	}
+}
+
+// shiftOctave taps OctaveUp or OctaveDown until the game's octave matches
+// target. Each tap counts as a modifier change for ModifierCooldown.
+func (app *application) shiftOctave(pInputs []keyInput, target int8, now time.Time) []keyInput {
+	for app.keyStatus.octave != target {
+		keybind := app.OctaveUp
+		if app.keyStatus.octave < target {
+			app.keyStatus.octave++
+		} else {
+			keybind = app.OctaveDown
+			app.keyStatus.octave--
 		}
-		app.printPressedKeys()
+		pInputs = append(pInputs, keyInput{VirtualKeyCode: keybind.VirtualKeyCode}, keyInput{VirtualKeyCode: keybind.VirtualKeyCode, KeyUp: true})
+		app.keyStatus.lastModifierTime = now
+	}
+	return pInputs
+}
+
+func (app *application) traceDroppedNote(now time.Time, note int, reason string) {
+	app.statistics.addDropped(reason)
+	if app.keystrokeTrace != nil {
+		app.keystrokeTrace(&keystrokeTraceEvent{
+			Time:    now,
+			Note:    note,
+			Dropped: true,
+			Reason:  reason,
+		})
+	}
+}
+
+func (app *application) traceDelayedNote(now time.Time, note int, delay time.Duration, reason string) {
+	app.statistics.addDelayed(reason, delay)
+	if app.keystrokeTrace != nil {
+		app.keystrokeTrace(&keystrokeTraceEvent{
+			Time:   now,
+			Note:   note,
+			Delay:  delay,
+			Reason: reason,
+		})
+	}
+}
+
+func (app *application) sendKeys(pInputs []keyInput) {
+	err := app.keySender.SendKeys(pInputs)
+	if err != nil {
+		log.Println("Error: ", err)
 	}
+	app.printPressedKeys()
 }
 
 func (app *application) printPressedKeys() {
@@ -0,0 +1,268 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	cgc "github.com/m13253/cgc-go"
+)
+
+// simulation runs the realtime, playback and keystroke code on a virtual
+// clock, the same way a dry run does, and records the keys sent.
+type simulation struct {
+	app            *application
+	clock          *virtualClock
+	keys           *recordingKeySender
+	keystrokeQueue *virtualActionQueue
+	midiOutQueue   *virtualActionQueue
+}
+
+func newSimulation(t *testing.T, p preset) *simulation {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	s := &simulation{
+		app:   &application{preset: p},
+		clock: newVirtualClock(time.Unix(0, 0).UTC()),
+		keys:  new(recordingKeySender),
+	}
+	app := s.app
+	app.initRuntimeState()
+	app.ctx, app.Quit = context.WithCancel(context.Background())
+	t.Cleanup(app.Quit)
+	app.clock = s.clock
+	app.keySender = s.keys
+	app.KeystrokeGoro = cgc.NewBuffered(1)
+	app.MidiRealtimeGoro = cgc.NewBuffered(1)
+	app.NtpGoro = cgc.NewBuffered(1)
+	app.MidiPlaybackGoro = cgc.NewBuffered(1)
+	s.keystrokeQueue = newVirtualActionQueue(s.clock)
+	app.keystrokeQueue = s.keystrokeQueue
+	s.midiOutQueue = newVirtualActionQueue(s.clock)
+	app.midiOutQueue = s.midiOutQueue
+	app.ntpMutex = new(sync.RWMutex)
+	app.statistics = newNoteStatistics(s.clock.Now())
+	app.initKeystrokes()
+	app.initMidiPlayback()
+	return s
+}
+
+// send delivers a message from the MIDI input device.
+func (s *simulation) send(message ...byte) {
+	s.app.onMidiInEvent(message)
+}
+
+// run processes everything due in the next d.
+func (s *simulation) run(d time.Duration) {
+	end := s.clock.Now().Add(d)
+	for {
+		if s.step() {
+			continue
+		}
+		nextTime, ok := s.clock.NextDeadline()
+		if actionTime, ok2 := s.keystrokeQueue.NextActionTime(); ok2 && (!ok || actionTime.Before(nextTime)) {
+			nextTime, ok = actionTime, true
+		}
+		if actionTime, ok2 := s.midiOutQueue.NextActionTime(); ok2 && (!ok || actionTime.Before(nextTime)) {
+			nextTime, ok = actionTime, true
+		}
+		if !ok || nextTime.After(end) {
+			s.clock.AdvanceTo(end)
+			for s.step() {
+			}
+			return
+		}
+		s.clock.AdvanceTo(nextTime)
+	}
+}
+
+// step is runOneDryRunStep, except that MIDI output is sent to
+// app.midiOutPort.
+func (s *simulation) step() bool {
+	if action := s.midiOutQueue.PopAction(s.clock.Now()); action != nil {
+		err := s.app.sendMidiOutMessage(action.Value.(*midiQueueEvent))
+		if err != nil {
+			panic(err)
+		}
+		return true
+	}
+	return s.app.runOneDryRunStep(s.clock, s.keystrokeQueue, s.midiOutQueue)
+}
+
+// takeKeys returns the keys sent so far, as "+Ctrl" for a press and "-Ctrl"
+// for a release, and forgets them.
+func (s *simulation) takeKeys() []string {
+	keys := []string{}
+	for _, input := range s.keys.Inputs {
+		if input.KeyUp {
+			keys = append(keys, "-"+keyName(input.VirtualKeyCode))
+		} else {
+			keys = append(keys, "+"+keyName(input.VirtualKeyCode))
+		}
+	}
+	s.keys.Inputs = nil
+	return keys
+}
+
+func (s *simulation) expectKeys(t *testing.T, want ...string) {
+	t.Helper()
+	got := s.takeKeys()
+	if len(want) == 0 {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got keys %q, want %q", got, want)
+	}
+}
+
+func TestRecordingKeySender(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+
+	// C5 needs Shift, which is released after IdleDuration
+	s.send(0x90, 0x48, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+Shift", "+'Q'")
+	s.send(0x80, 0x48, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "-'Q'")
+	s.run(defaultPreset.IdleDuration)
+	s.expectKeys(t, "-Shift")
+
+	// The same key for another note is released before it is pressed again
+	s.send(0x90, 0x3c, 0x40)
+	s.run(200 * time.Millisecond)
+	s.send(0x90, 0x30, 0x40)
+	s.run(200 * time.Millisecond)
+	s.send(0x80, 0x3c, 0x00)
+	s.send(0x80, 0x30, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'Q'", "-'Q'", "+Ctrl", "+'Q'", "-'Q'")
+}
+
+func TestOutOfRangePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy    string
+		transpose int
+		note      uint8
+		want      []string
+	}{
+		// G#5 + 4 octaves is above 127
+		{"drop", 48, 0x50, []string{}},
+		{"fold", 48, 0x50, []string{"+Shift", "+'6'", "-'6'"}},
+		{"clamp", 48, 0x50, []string{"+Shift", "+'I'", "-'I'"}},
+		// C3 - 6 octaves is below 0
+		{"drop", -72, 0x30, []string{}},
+		{"fold", -72, 0x30, []string{"+Ctrl", "+'Q'", "-'Q'"}},
+		{"clamp", -72, 0x30, []string{"+Ctrl", "+'Q'", "-'Q'"}},
+		// C7 has no keybinding
+		{"drop", 12, 0x54, []string{}},
+		{"fold", 12, 0x54, []string{"+Shift", "+'I'", "-'I'"}},
+		{"clamp", 12, 0x54, []string{"+Shift", "+'I'", "-'I'"}},
+	} {
+		s := newSimulation(t, defaultPreset)
+		s.app.OutOfRangePolicy = test.policy
+		s.app.MidiChannelRouting[0].Transpose = test.transpose
+		s.send(0x90, test.note, 0x40)
+		s.run(10 * time.Millisecond)
+		s.send(0x80, test.note, 0x00)
+		s.run(10 * time.Millisecond)
+		got := s.takeKeys()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %+d %#02x: got keys %q, want %q", test.policy, test.transpose, test.note, got, test.want)
+		}
+		dropped := s.app.statistics.snapshot().Dropped
+		if test.policy == "drop" && dropped["transposed out of range"]+dropped["no keybinding"] != 1 {
+			t.Errorf("%s %+d %#02x: got dropped %v", test.policy, test.transpose, test.note, dropped)
+		}
+	}
+}
+
+func TestSustainPedal(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+
+	// A note-off with the pedal held keeps the key down
+	s.send(0xb0, 0x40, 0x7f)
+	s.send(0x90, 0x3c, 0x40)
+	s.run(10 * time.Millisecond)
+	s.send(0x80, 0x3c, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'Q'")
+	if !s.app.keyStatus.sustainedNotes[0x3c] {
+		t.Fatal("C4 is not sustained")
+	}
+
+	// Lifting the pedal releases it
+	s.send(0xb0, 0x40, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "-'Q'")
+	if s.app.keyStatus.sustainedNotes[0x3c] {
+		t.Fatal("C4 is still sustained")
+	}
+
+	// A new note ends the sustained ones
+	s.send(0xb0, 0x40, 0x7f)
+	s.send(0x90, 0x3c, 0x40)
+	s.run(10 * time.Millisecond)
+	s.send(0x80, 0x3c, 0x00)
+	s.run(200 * time.Millisecond)
+	s.send(0x90, 0x3e, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'Q'", "-'Q'", "+'W'")
+	if s.app.keyStatus.sustainedNotes[0x3c] {
+		t.Fatal("C4 is still sustained")
+	}
+	s.send(0x80, 0x3e, 0x00)
+	s.send(0xb0, 0x40, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "-'W'")
+}
+
+func TestAllNotesOffReleasesSustain(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+
+	s.send(0xb0, 0x40, 0x7f)
+	s.send(0x90, 0x3c, 0x40)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'Q'")
+	s.send(0xb0, 0x7b, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "-'Q'")
+
+	// The pedal is forgotten, so the next note-off is not sustained
+	s.send(0x90, 0x3e, 0x40)
+	s.run(10 * time.Millisecond)
+	s.send(0x80, 0x3e, 0x00)
+	s.run(10 * time.Millisecond)
+	s.expectKeys(t, "+'W'", "-'W'")
+}
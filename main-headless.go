@@ -0,0 +1,75 @@
+// +build !windows
+
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const defaultMidiDriver = "loopback"
+
+func (app *application) initPlatform() error {
+	log.Println("Running in headless mode, keystrokes will not be sent.")
+	return nil
+}
+
+func (app *application) newKeySender() keySender {
+	return nullKeySender{}
+}
+
+func (app *application) newMidiDriver(name string) (midiDriver, error) {
+	switch name {
+	case "loopback":
+		return newCrossedLoopbackMidiDriver("Loopback A", "Loopback B"), nil
+	default:
+		return nil, fmt.Errorf("unknown MIDI driver %q", name)
+	}
+}
+
+func (app *application) runMainLoop() {
+	go app.consumeStdin()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-signals:
+	case <-app.ctx.Done():
+	}
+}
+
+func (app *application) consumeStdin() {
+	app.readConsoleCommands(os.Stdin)
+}
+
+func (app *application) delayReturn(code int) int {
+	return code
+}
@@ -0,0 +1,181 @@
+// +build windows
+
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"github.com/m13253/midi2ffxiv/kernel32"
+	"github.com/m13253/midi2ffxiv/user32"
+)
+
+const defaultMidiDriver = "winmm"
+
+func (app *application) initPlatform() error {
+	runtime.LockOSThread()
+	_ = kernel32.SetPriorityClass(kernel32.GetCurrentProcess(), kernel32.HIGH_PRIORITY_CLASS)
+
+	hWndClass, err := user32.RegisterClassEx(0, app.windowProc, 0, 0, 0, 0, 0, 0, 0, "midi2ffxiv", 0)
+	if err != nil {
+		return err
+	}
+	app.hWnd, err = user32.CreateWindowEx(0, uintptr(hWndClass), "midi2ffxiv", 0, 0, 0, 0, 0, user32.HWND_MESSAGE, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	if app.EmergencyStop != nil && app.EmergencyStop.VirtualKeyCode != 0 {
+		hotkeyModifiers := user32.MOD_NOREPEAT
+		if app.EmergencyStop.Ctrl {
+			hotkeyModifiers |= user32.MOD_CONTROL
+		}
+		if app.EmergencyStop.Alt {
+			hotkeyModifiers |= user32.MOD_ALT
+		}
+		if app.EmergencyStop.Shift {
+			hotkeyModifiers |= user32.MOD_SHIFT
+		}
+		_, err := user32.RegisterHotKey(app.hWnd, 1, uint32(hotkeyModifiers), uint32(app.EmergencyStop.VirtualKeyCode))
+		if err != nil {
+			log.Println("Failed to register emergency stop hotkey, is another instance running?")
+			log.Println("Error: ", err)
+		}
+	}
+	return nil
+}
+
+func (app *application) newKeySender() keySender {
+	return sendInputKeySender{}
+}
+
+func (app *application) newMidiDriver(name string) (midiDriver, error) {
+	switch name {
+	case "winmm":
+		return newWinmmMidiDriver(app.hWnd), nil
+	case "loopback":
+		return newCrossedLoopbackMidiDriver("Loopback A", "Loopback B"), nil
+	default:
+		return nil, fmt.Errorf("unknown MIDI driver %q", name)
+	}
+}
+
+func (app *application) runMainLoop() {
+	go app.consumeStdin()
+	go app.waitForQuit()
+
+	for {
+		bResult, lpMsg, err := user32.GetMessage(app.hWnd, 0, 0)
+		if err != nil {
+			log.Println("Error: ", err)
+			os.Exit(int(err.(syscall.Errno)))
+		}
+		if bResult == 0 {
+			break
+		}
+		_ = user32.TranslateMessage(lpMsg)
+		_ = user32.DispatchMessage(lpMsg)
+	}
+}
+
+func (app *application) consumeStdin() {
+	hStdin := kernel32.GetStdHandle(kernel32.STD_INPUT_HANDLE)
+	if hStdin == 0 || hStdin == kernel32.INVALID_HANDLE_VALUE {
+		return
+	}
+	bResult, dwMode, _ := kernel32.GetConsoleMode(hStdin)
+	if !bResult {
+		// Redirected, for example over SSH
+		app.readConsoleCommands(os.Stdin)
+		return
+	}
+	dwMode &= ^kernel32.ENABLE_PROCESSED_INPUT
+	_, _ = kernel32.SetConsoleMode(hStdin, dwMode)
+	// Console commands are echoed and edited by ourselves, since line input
+	// mode would swallow the hotkeys
+	var line []uint16
+	var lpBuffer [16]kernel32.INPUT_RECORD_KEY_EVENT
+	for {
+		bResult, lpNumberOfEventsRead, _ := kernel32.ReadConsoleInput(hStdin, lpBuffer[:], uint32(len(lpBuffer)))
+		if !bResult || lpNumberOfEventsRead == 0 {
+			break
+		}
+		for _, event := range lpBuffer[:lpNumberOfEventsRead] {
+			if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.WVirtualKeyCode == 'C' && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_CTRL_PRESSED|kernel32.RIGHT_CTRL_PRESSED)) != 0 {
+				app.Quit()
+			} else if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.BKeyDown != 0 && event.KeyEvent.WVirtualKeyCode == user32.VK_ESCAPE {
+				log.Println("Emergency stop pressed on the console!")
+				app.cmdEmergencyStop()
+			} else if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.WVirtualKeyCode == 'P' && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_CTRL_PRESSED|kernel32.RIGHT_CTRL_PRESSED)) != 0 && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_ALT_PRESSED|kernel32.RIGHT_ALT_PRESSED)) != 0 && (event.KeyEvent.DwControlKeyState&kernel32.SHIFT_PRESSED) != 0 {
+				app.printStackTrace()
+			} else if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.BKeyDown != 0 {
+				switch char := event.KeyEvent.UnicodeChar; {
+				case char == '\r':
+					fmt.Println()
+					app.runConsoleCommand(string(utf16.Decode(line)))
+					line = line[:0]
+				case char == '\b' && len(line) != 0:
+					fmt.Print("\b \b")
+					line = line[:len(line)-1]
+				case char >= 0x20:
+					fmt.Print(string(utf16.Decode([]uint16{char})))
+					line = append(line, char)
+				}
+			}
+		}
+	}
+}
+
+func (app *application) delayReturn(code int) int {
+	fmt.Fprint(os.Stderr, "\nPress Ctrl-C to exit...")
+	time.Sleep(1 * time.Minute)
+	fmt.Fprintln(os.Stderr)
+	return code
+}
+
+func (app *application) waitForQuit() {
+	<-app.ctx.Done()
+	_, _ = user32.PostMessage(app.hWnd, user32.WM_QUIT, 0, 0)
+}
+
+func (app *application) windowProc(hWnd uintptr, uMsg uint32, wParam, lParam uintptr) uintptr {
+	switch uMsg {
+	case user32.WM_HOTKEY:
+		log.Println("Emergency stop pressed!")
+		app.cmdEmergencyStop()
+	default:
+		if midiDriver, ok := app.midiDriver.(*winmmMidiDriver); ok && midiDriver.handleWindowMessage(uMsg, wParam, lParam) {
+			return 0
+		}
+		return user32.DefWindowProc(hWnd, uMsg, wParam, lParam)
+	}
+	return 0
+}
@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -34,18 +32,16 @@ import (
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
 	actionqueue "github.com/m13253/actionqueue-go"
 	cgc "github.com/m13253/cgc-go"
-
-	"github.com/m13253/midi2ffxiv/kernel32"
-	"github.com/m13253/midi2ffxiv/user32"
-	"github.com/m13253/midi2ffxiv/winmm"
 )
 
 var versionInfo string
 
+// Each piece of mutable state in application is owned by one executor, and
+// may only be touched from there. Other goroutines go through the cmd* and
+// snapshot* functions in commands.go.
 type application struct {
 	preset
 
@@ -55,37 +51,60 @@ type application struct {
 	MidiPlaybackGoro cgc.Executor
 	KeystrokeGoro    cgc.Executor
 
-	MidiInDevice                int
-	MidiOutDevice               int
-	MidiOutBank                 uint16
-	MidiOutPatch                uint8
-	MidiOutTranspose            int
-	MidiPlaybackTrack           uint16
-	MidiPlaybackOffset          time.Duration
-	MidiPlaybackSchedule        time.Time
-	MidiPlaybackScheduleEnabled bool
-	MidiPlaybackLoop            time.Duration
-	MidiPlaybackLoopEnabled     bool
-	NtpSyncServer               string
-	NtpLastSync                 time.Time
-	NtpClockOffset              time.Duration
-	NtpMaxDeviation             time.Duration
-
-	ctx context.Context
-
-	hWnd        uintptr
-	hMidiIn     uintptr
-	hMidiOut    uintptr
-	sysexBuffer [2]*winmm.MIDIHDR
-
-	midiOutQueue   *actionqueue.Queue
-	keystrokeQueue *actionqueue.Queue
-
+	// Owned by MidiRealtimeGoro
+	MidiInDevice       int
+	MidiOutDevice      int
+	MidiOutBank        uint16
+	MidiOutPatch       uint8
+	MidiOutTranspose   int
+	MidiChannelRouting [16]midiChannelRoute
+	MidiSplitZones     []splitZone
+	MidiLearnActive    bool
+	MidiLearnNote      int
+	MidiInMuted        bool
+	MidiControlDevice  int
+	midiControlPort    midiInPort
+	midiPitchBend      *[2][16]pitchBendStatus
+	midiInPort         midiInPort
+	midiOutPort        midiOutPort
+
+	// Owned by MidiPlaybackGoro
+	MidiPlaybackTracks           []uint16
+	MidiPlaybackChannels         uint16
+	MidiPlaybackOffset           time.Duration
+	MidiPlaybackSpeed            float64
+	MidiPlaybackSchedule         time.Time
+	MidiPlaybackScheduleEnabled  bool
+	MidiPlaybackLoop             time.Duration
+	MidiPlaybackLoopEnabled      bool
+	MidiPlaybackOutOfRangePolicy string
+	midiFileBuffer               *midiFileBuffer
+
+	// Owned by NtpGoro, which holds ntpMutex while writing,
+	// so other goroutines can read them with snapshotNtp
+	NtpSyncServer   string
+	NtpLastSync     time.Time
+	NtpClockOffset  time.Duration
+	NtpMaxDeviation time.Duration
+	ntpMutex        *sync.RWMutex
+
+	// Owned by KeystrokeGoro
 	keyStatus *keystrokeStatus
 
-	midiFileBuffer *midiFileBuffer
-
-	ntpMutex *sync.RWMutex
+	// Set up before the executors start, read-only afterwards
+	ctx            context.Context
+	clock          clock
+	hWnd           uintptr
+	midiDriver     midiDriver
+	midiOutQueue   actionQueue
+	keystrokeQueue actionQueue
+	keySender      keySender
+	keystrokeTrace func(event *keystrokeTraceEvent)
+	statistics     *noteStatistics
+	// Incremented by emergencyStop, read and written with sync/atomic
+	midiGeneration uint32
+	// Closed when KeystrokeGoro has released all keys and quit
+	keystrokeStopped chan struct{}
 }
 
 func main() {
@@ -94,9 +113,6 @@ func main() {
 }
 
 func (app *application) run(args []string) int {
-	runtime.LockOSThread()
-	_ = kernel32.SetPriorityClass(kernel32.GetCurrentProcess(), kernel32.HIGH_PRIORITY_CLASS)
-
 	fmt.Println("MIDI2FFXIV")
 	if versionInfo != "" {
 		fmt.Printf("Version: %s\n", versionInfo)
@@ -112,26 +128,8 @@ func (app *application) run(args []string) int {
 		return app.delayReturn(1)
 	}
 
-	app.ctx, app.Quit = context.WithCancel(context.Background())
-
-	app.KeystrokeGoro = cgc.NewBuffered(1)
-	app.MidiRealtimeGoro = cgc.NewBuffered(1)
-	app.NtpGoro = cgc.NewBuffered(1)
-	app.MidiPlaybackGoro = cgc.NewBuffered(1)
-
-	app.MidiInDevice = -1
-	app.MidiOutDevice = -1
-	app.MidiOutBank = 0
-	app.MidiOutPatch = 46
-	app.MidiOutTranspose = 0
-	app.MidiPlaybackTrack = 1
-
-	app.midiOutQueue = actionqueue.New()
-	app.midiOutQueue.Run(app.ctx)
-	app.keystrokeQueue = actionqueue.New()
-	app.keystrokeQueue.Run(app.ctx)
-
-	app.ntpMutex = new(sync.RWMutex)
+	app.initState()
+	app.keySender = app.newKeySender()
 
 	err = app.startWebServer()
 	if err != nil {
@@ -139,150 +137,97 @@ func (app *application) run(args []string) int {
 		return app.delayReturn(1)
 	}
 
-	hWndClass, err := user32.RegisterClassEx(0, app.windowProc, 0, 0, 0, 0, 0, 0, 0, "midi2ffxiv", 0)
+	err = app.initPlatform()
 	if err != nil {
 		log.Println("Error: ", err)
-		return app.delayReturn(int(err.(syscall.Errno)))
+		if errno, ok := err.(syscall.Errno); ok {
+			return app.delayReturn(int(errno))
+		}
+		return app.delayReturn(1)
 	}
-	app.hWnd, err = user32.CreateWindowEx(0, uintptr(hWndClass), "midi2ffxiv", 0, 0, 0, 0, 0, user32.HWND_MESSAGE, 0, 0, nil)
+
+	app.midiDriver, err = app.newMidiDriver(app.MidiDriver)
 	if err != nil {
 		log.Println("Error: ", err)
-		return app.delayReturn(int(err.(syscall.Errno)))
-	}
-	if app.EmergencyStop != nil && app.EmergencyStop.VirtualKeyCode != 0 {
-		hotkeyModifiers := user32.MOD_NOREPEAT
-		if app.EmergencyStop.Ctrl {
-			hotkeyModifiers |= user32.MOD_CONTROL
-		}
-		if app.EmergencyStop.Alt {
-			hotkeyModifiers |= user32.MOD_ALT
-		}
-		if app.EmergencyStop.Shift {
-			hotkeyModifiers |= user32.MOD_SHIFT
-		}
-		_, err := user32.RegisterHotKey(app.hWnd, 1, uint32(hotkeyModifiers), uint32(app.EmergencyStop.VirtualKeyCode))
-		if err != nil {
-			log.Println("Failed to register emergency stop hotkey, is another instance running?")
-			log.Println("Error: ", err)
-		}
+		return app.delayReturn(1)
 	}
 
-	go app.consumeStdin()
-	go app.processKeystrokes()
-	go app.processMidiPlayback()
-	go app.processMidiRealtime()
-	go app.processNTP()
-	go app.waitForQuit()
+	app.startExecutors()
 
-	for {
-		bResult, lpMsg, err := user32.GetMessage(app.hWnd, 0, 0)
-		if err != nil {
-			log.Println("Error: ", err)
-			os.Exit(int(err.(syscall.Errno)))
-		}
-		if bResult == 0 {
-			break
-		}
-		_ = user32.TranslateMessage(lpMsg)
-		_ = user32.DispatchMessage(lpMsg)
-	}
+	app.runMainLoop()
 
 	app.Quit()
+	app.waitForKeystrokes()
 
 	return 0
 }
 
-func (app *application) consumeStdin() {
-	hStdin := kernel32.GetStdHandle(kernel32.STD_INPUT_HANDLE)
-	if hStdin == 0 || hStdin == kernel32.INVALID_HANDLE_VALUE {
-		return
-	}
-	_, dwMode, err := kernel32.GetConsoleMode(hStdin)
-	if err == nil {
-		dwMode &= ^kernel32.ENABLE_PROCESSED_INPUT
-		_, _ = kernel32.SetConsoleMode(hStdin, dwMode)
-	}
-	var lpBuffer [16]kernel32.INPUT_RECORD_KEY_EVENT
-	for {
-		bResult, lpNumberOfEventsRead, _ := kernel32.ReadConsoleInput(hStdin, lpBuffer[:], uint32(len(lpBuffer)))
-		if !bResult || lpNumberOfEventsRead == 0 {
-			break
-		}
-		for _, event := range lpBuffer[:lpNumberOfEventsRead] {
-			if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.WVirtualKeyCode == 'C' && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_CTRL_PRESSED|kernel32.RIGHT_CTRL_PRESSED)) != 0 {
-				app.Quit()
-			} else if event.EventType == kernel32.KEY_EVENT && event.KeyEvent.WVirtualKeyCode == 'P' && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_CTRL_PRESSED|kernel32.RIGHT_CTRL_PRESSED)) != 0 && (event.KeyEvent.DwControlKeyState&(kernel32.LEFT_ALT_PRESSED|kernel32.RIGHT_ALT_PRESSED)) != 0 && (event.KeyEvent.DwControlKeyState&kernel32.SHIFT_PRESSED) != 0 {
-				log.Println("Stack trace requested")
-				buf := make([]byte, 1024)
-				for {
-					n := runtime.Stack(buf, true)
-					if n < len(buf) {
-						fmt.Println(string(buf[:n]))
-						break
-					}
-					buf = make([]byte, 2*len(buf))
-				}
-			}
-		}
-	}
+func (app *application) initState() {
+	app.ctx, app.Quit = context.WithCancel(context.Background())
+	app.clock = systemClock{}
+
+	app.KeystrokeGoro = cgc.NewBuffered(1)
+	app.MidiRealtimeGoro = cgc.NewBuffered(1)
+	app.NtpGoro = cgc.NewBuffered(1)
+	app.MidiPlaybackGoro = cgc.NewBuffered(1)
+
+	app.initRuntimeState()
+
+	midiOutQueue := actionqueue.New()
+	midiOutQueue.Run(app.ctx)
+	app.midiOutQueue = midiOutQueue
+	keystrokeQueue := actionqueue.New()
+	keystrokeQueue.Run(app.ctx)
+	app.keystrokeQueue = keystrokeQueue
+
+	app.ntpMutex = new(sync.RWMutex)
+	app.statistics = newNoteStatistics(app.clock.Now())
+	app.keystrokeStopped = make(chan struct{})
 }
 
-func (app *application) delayReturn(code int) int {
-	fmt.Fprint(os.Stderr, "\nPress Ctrl-C to exit...")
-	time.Sleep(1 * time.Minute)
-	fmt.Fprintln(os.Stderr)
-	return code
+// initRuntimeState sets the settings that can be changed at runtime to their
+// startup values, derived from the preset.
+func (app *application) initRuntimeState() {
+	app.MidiInDevice = -1
+	app.MidiOutDevice = -1
+	app.MidiOutBank = 0
+	app.MidiOutPatch = 46
+	app.MidiOutTranspose = 0
+	app.MidiChannelRouting = app.MidiChannel
+	app.MidiSplitZones = append([]splitZone(nil), app.SplitZone...)
+	app.MidiLearnNote = -1
+	app.MidiControlDevice = -1
+	app.MidiPlaybackTracks = []uint16{1}
+	app.MidiPlaybackChannels = allMidiChannels
+	app.MidiPlaybackSpeed = 1
 }
 
-func (app *application) waitForQuit() {
-	<-app.ctx.Done()
-	_, _ = user32.PostMessage(app.hWnd, user32.WM_QUIT, 0, 0)
+func (app *application) startExecutors() {
+	go app.processKeystrokes()
+	go app.processMidiPlayback()
+	go app.processMidiRealtime()
+	go app.processNTP()
 }
 
-func (app *application) windowProc(hWnd uintptr, uMsg uint32, wParam, lParam uintptr) uintptr {
-	switch uMsg {
-	case user32.WM_HOTKEY:
-		log.Println("Emergency stop pressed!")
-		app.MidiPlaybackGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
-			app.setMidiPlaybackScheduler(false, app.MidiPlaybackSchedule, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop)
-			return nil, nil
-		})
-	case winmm.MM_MIM_OPEN:
-		// no-op
-	case winmm.MM_MIM_CLOSE:
-		// no-op
-	case winmm.MM_MIM_DATA, winmm.MM_MIM_MOREDATA:
-		midiEvent := []byte{byte(lParam), byte(lParam >> 8), byte(lParam >> 16)}
-		app.MidiRealtimeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
-			app.onMidiInEvent(midiEvent)
-			return nil, nil
-		})
-	case winmm.MM_MIM_LONGDATA:
-		midiHeader := (*winmm.MIDIHDR)(unsafe.Pointer(lParam))
-		midiEvent := make([]byte, midiHeader.DwBytesRecorded)
-		copy(midiEvent, (*[65536]byte)(unsafe.Pointer(midiHeader.LpData))[:midiHeader.DwBytesRecorded])
-		app.MidiRealtimeGoro.Submit(app.ctx, func(context.Context) (interface{}, error) {
-			app.onMidiInEvent(midiEvent)
-			return nil, nil
-		})
-		err := winmm.MidiInAddBuffer(app.hMidiIn, midiHeader)
-		if err != nil {
-			log.Println("Error: ", err)
-		}
-	case winmm.MM_MIM_ERROR:
-		midiEvent := []byte{byte(lParam), byte(lParam >> 8), byte(lParam >> 16)}
-		log.Printf("Invalid MIDI message: %x\n", midiEvent)
-	case winmm.MM_MIM_LONGERROR:
-		midiHeader := (*winmm.MIDIHDR)(unsafe.Pointer(lParam))
-		midiEvent := make([]byte, midiHeader.DwBytesRecorded)
-		copy(midiEvent, (*[65536]byte)(unsafe.Pointer(midiHeader.LpData))[:midiHeader.DwBytesRecorded])
-		log.Printf("Invalid MIDI message: %x\n", midiEvent)
-		err := winmm.MidiInAddBuffer(app.hMidiIn, midiHeader)
-		if err != nil {
-			log.Println("Error: ", err)
+// waitForKeystrokes gives KeystrokeGoro a moment to release all keys before
+// the program exits.
+func (app *application) waitForKeystrokes() {
+	select {
+	case <-app.keystrokeStopped:
+	case <-time.After(time.Second):
+		log.Println("Timed out waiting for keys to be released.")
+	}
+}
+
+func (app *application) printStackTrace() {
+	log.Println("Stack trace requested")
+	buf := make([]byte, 1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			fmt.Println(string(buf[:n]))
+			break
 		}
-	default:
-		return user32.DefWindowProc(hWnd, uMsg, wParam, lParam)
+		buf = make([]byte, 2*len(buf))
 	}
-	return 0
 }
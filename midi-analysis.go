@@ -0,0 +1,162 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// midiAnalysisTransposes are the transposes compared in the analysis.
+var midiAnalysisTransposes = []int{-36, -24, -12, 0, 12, 24, 36}
+
+// midiTrackAnalysis describes one track of a MIDI file, so that an ensemble
+// can decide who plays which part. Duration is in seconds.
+type midiTrackAnalysis struct {
+	Track              int                     `json:"track"`
+	Name               string                  `json:"name"`
+	Channels           []int                   `json:"channels"`
+	Programs           []string                `json:"programs"`
+	Notes              int                     `json:"notes"`
+	LowestNote         string                  `json:"lowest_note,omitempty"`
+	HighestNote        string                  `json:"highest_note,omitempty"`
+	Duration           float64                 `json:"duration"`
+	MaxPolyphony       int                     `json:"max_polyphony"`
+	CooldownViolations int                     `json:"cooldown_violations"`
+	OutOfRange         []midiTransposeAnalysis `json:"out_of_range"`
+}
+
+// midiTransposeAnalysis counts the notes without keybinding if the track is
+// played with that transpose.
+type midiTransposeAnalysis struct {
+	Transpose int `json:"transpose"`
+	Notes     int `json:"notes"`
+}
+
+// analyzeMidiSequence only reads the preset, so it is safe to call from any
+// goroutine, as long as sequence is not modified.
+//
+// Like in playback, a note is played on the key of the note minus the
+// transpose, plus the transpose of its channel in routing.
+func (app *application) analyzeMidiSequence(sequence *midimark.Sequence, keybindings *[128]keybindingPreset, routing *[16]midiChannelRoute) []midiTrackAnalysis {
+	result := make([]midiTrackAnalysis, 0, len(sequence.Tracks))
+	for i, thisTrack := range sequence.Tracks {
+		analysis := midiTrackAnalysis{
+			Track:      i,
+			Name:       midiTrackName(thisTrack),
+			Channels:   []int{},
+			Programs:   []string{},
+			OutOfRange: make([]midiTransposeAnalysis, len(midiAnalysisTransposes)),
+		}
+		for j, transpose := range midiAnalysisTransposes {
+			analysis.OutOfRange[j].Transpose = transpose
+		}
+
+		channels, programChannels := uint16(0), uint16(0)
+		programs := map[string]bool{}
+		lowest, highest := -1, -1
+		var pressed [16][128]int
+		polyphony := 0
+		lastNoteOn := time.Duration(-1)
+		for _, event := range thisTrack.Events {
+			progress := thisTrack.ConvertAbsTickToDuration(event.Common().AbsTick)
+			if seconds := float64(progress/time.Nanosecond) * 1e-9; seconds > analysis.Duration {
+				analysis.Duration = seconds
+			}
+			status := event.Status()
+			if status < 0x80 || status >= 0xf0 {
+				continue
+			}
+			channel := int(status & 0x0f)
+			channels |= 1 << uint(channel)
+
+			switch event := event.(type) {
+			case *midimark.EventProgramChange:
+				programChannels |= 1 << uint(channel)
+				// midimark numbers programs from 1
+				name := midiProgramName(channel, int(event.Program)-1)
+				if !programs[name] {
+					programs[name] = true
+					analysis.Programs = append(analysis.Programs, name)
+				}
+			case *midimark.EventNoteOn:
+				key := int(event.Key) & 0x7f
+				if event.Velocity == 0 {
+					if pressed[channel][key] > 0 {
+						pressed[channel][key]--
+						polyphony--
+					}
+					break
+				}
+				analysis.Notes++
+				if lowest < 0 || key < lowest {
+					lowest = key
+				}
+				if key > highest {
+					highest = key
+				}
+				pressed[channel][key]++
+				polyphony++
+				if polyphony > analysis.MaxPolyphony {
+					analysis.MaxPolyphony = polyphony
+				}
+				// Notes at the same time are chords, not counted here
+				if lastNoteOn >= 0 && progress != lastNoteOn && progress-lastNoteOn < app.SkillCooldown {
+					analysis.CooldownViolations++
+				}
+				lastNoteOn = progress
+				for j, transpose := range midiAnalysisTransposes {
+					note := key + routing[channel].Transpose - transpose
+					if note < 0x00 || note > 0x7f || keybindings[note].VirtualKeyCode == 0 {
+						analysis.OutOfRange[j].Notes++
+					}
+				}
+			case *midimark.EventNoteOff:
+				key := int(event.Key) & 0x7f
+				if pressed[channel][key] > 0 {
+					pressed[channel][key]--
+					polyphony--
+				}
+			}
+		}
+		// Channels without program change play the default program
+		for channel := 0; channel < 16; channel++ {
+			if channels&^programChannels&(1<<uint(channel)) == 0 {
+				continue
+			}
+			if name := midiProgramName(channel, -1); !programs[name] {
+				programs[name] = true
+				analysis.Programs = append(analysis.Programs, name)
+			}
+		}
+		analysis.Channels = midiChannelList(channels)
+		if lowest >= 0 {
+			analysis.LowestNote, _ = noteIndexToName(uint8(lowest))
+			analysis.HighestNote, _ = noteIndexToName(uint8(highest))
+		}
+		result = append(result, analysis)
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeMidiSequence(t *testing.T) {
+	// 960 ticks per second
+	sequence := decodeTestMidiFile(t, 1, nil, []testMidiEvent{
+		{0, []byte{0xc0, 40}},
+		{0, []byte{0x90, 0x3c, 0x40}},
+		{0, []byte{0x90, 0x40, 0x40}},
+		{0, []byte{0x90, 0x43, 0x40}},
+		{0, []byte{0x90, 0x47, 0x40}},
+		{480, []byte{0x80, 0x3c, 0x00}},
+		{480, []byte{0x80, 0x40, 0x00}},
+		{480, []byte{0x80, 0x43, 0x00}},
+		{480, []byte{0x80, 0x47, 0x00}},
+		// 62.5ms apart, faster than SkillCooldown
+		{480, []byte{0x90, 0x48, 0x40}},
+		{540, []byte{0x90, 0x4a, 0x40}},
+		{600, []byte{0x90, 0x4c, 0x40}},
+		{960, []byte{0x90, 0x48, 0x00}},
+		{960, []byte{0x80, 0x4a, 0x00}},
+		{960, []byte{0x80, 0x4c, 0x00}},
+	}, []testMidiEvent{
+		{0, []byte{0x91, 0x18, 0x40}},
+		{0, []byte{0x99, 0x24, 0x40}},
+		{480, []byte{0x81, 0x18, 0x00}},
+		{480, []byte{0x89, 0x24, 0x00}},
+	})
+	routing := defaultPreset.MidiChannel
+	routing[1].Transpose = 12
+	app := &application{preset: defaultPreset}
+
+	outOfRange := func(notes ...int) []midiTransposeAnalysis {
+		result := make([]midiTransposeAnalysis, len(notes))
+		for i := range notes {
+			result[i] = midiTransposeAnalysis{midiAnalysisTransposes[i], notes[i]}
+		}
+		return result
+	}
+	want := []midiTrackAnalysis{
+		{
+			Track:      0,
+			Channels:   []int{},
+			Programs:   []string{},
+			OutOfRange: outOfRange(0, 0, 0, 0, 0, 0, 0),
+		},
+		{
+			Track:              1,
+			Channels:           []int{1},
+			Programs:           []string{"Violin"},
+			Notes:              7,
+			LowestNote:         "C4",
+			HighestNote:        "E5",
+			Duration:           1,
+			MaxPolyphony:       4,
+			CooldownViolations: 2,
+			OutOfRange:         outOfRange(7, 6, 2, 0, 0, 4, 7),
+		},
+		{
+			// Channel 2 has no program change, and is transposed by routing
+			Track:        2,
+			Channels:     []int{2, 10},
+			Programs:     []string{"Acoustic Grand Piano", "Percussion"},
+			Notes:        2,
+			LowestNote:   "C1",
+			HighestNote:  "C2",
+			Duration:     0.5,
+			MaxPolyphony: 2,
+			OutOfRange:   outOfRange(0, 0, 0, 2, 2, 2, 2),
+		},
+	}
+	got := app.analyzeMidiSequence(sequence, &defaultPreset.Keybinding, &routing)
+	if len(got) != len(want) {
+		t.Fatalf("got %d tracks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("track %d:\n got: %+v\nwant: %+v", i, got[i], want[i])
+		}
+	}
+}
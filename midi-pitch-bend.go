@@ -0,0 +1,212 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+var pitchBendPolicies = []string{"ignore", "step", "glide"}
+
+// pitchBendStatus tracks the pitch bend of a MIDI channel, and the notes held
+// on it, so they can be played again at the bent pitch.
+type pitchBendStatus struct {
+	// Selected by CC 101 and CC 100, 0x3fff is none
+	rpn uint16
+	// Set by RPN 0, 2 semitones by default
+	rangeCents int
+	// The bend, rounded to semitones
+	offset int
+	notes  [128]pitchBendNote
+}
+
+type pitchBendNote struct {
+	held     bool
+	velocity uint8
+	// The bend when the note started
+	offset int
+}
+
+func newPitchBendStatus() pitchBendStatus {
+	return pitchBendStatus{
+		rpn:        0x3fff,
+		rangeCents: 200,
+	}
+}
+
+// pitchBendStatus returns nil if pitch bend is ignored. Realtime input and
+// MIDI file playback are tracked separately.
+func (app *application) pitchBendStatus(event *midiQueueEvent) *pitchBendStatus {
+	if app.PitchBendPolicy == "ignore" || event.Message[0] >= 0xf0 {
+		return nil
+	}
+	if app.midiPitchBend == nil {
+		app.resetPitchBend(true)
+		app.resetPitchBend(false)
+	}
+	realtime := 0
+	if event.Realtime {
+		realtime = 1
+	}
+	return &app.midiPitchBend[realtime][event.Message[0]&0xf]
+}
+
+func (app *application) resetPitchBend(realtime bool) {
+	if app.midiPitchBend == nil {
+		app.midiPitchBend = new([2][16]pitchBendStatus)
+	}
+	index := 0
+	if realtime {
+		index = 1
+	}
+	for i := range app.midiPitchBend[index] {
+		app.midiPitchBend[index][i] = newPitchBendStatus()
+	}
+}
+
+// noteOn returns the bend to play the note with.
+func (status *pitchBendStatus) noteOn(note, velocity uint8) int {
+	status.notes[note] = pitchBendNote{
+		held:     true,
+		velocity: velocity,
+		offset:   status.offset,
+	}
+	return status.offset
+}
+
+// noteOff returns the bend the note was played with.
+func (status *pitchBendStatus) noteOff(note uint8) int {
+	offset := status.noteOffset(note)
+	status.notes[note].held = false
+	return offset
+}
+
+func (status *pitchBendStatus) noteOffset(note uint8) int {
+	if status.notes[note].held {
+		return status.notes[note].offset
+	}
+	return status.offset
+}
+
+func (status *pitchBendStatus) controlChange(controller, value uint8) {
+	switch controller {
+	// Data entry MSB, semitones
+	case 0x06:
+		if status.rpn == 0 {
+			status.rangeCents = int(value)*100 + status.rangeCents%100
+		}
+	// Data entry LSB, cents
+	case 0x26:
+		if status.rpn == 0 {
+			status.rangeCents = status.rangeCents/100*100 + int(value)
+		}
+	// RPN LSB
+	case 0x64:
+		status.rpn = status.rpn&0x3f80 | uint16(value)
+	// RPN MSB
+	case 0x65:
+		status.rpn = status.rpn&0x7f | uint16(value)<<7
+	// Reset all controllers
+	case 0x79:
+		status.rpn = 0x3fff
+		status.offset = 0
+	// All sound off, all notes off
+	case 0x78, 0x7b:
+		status.notes = [128]pitchBendNote{}
+	}
+}
+
+// bendOffset converts a pitch bend value to semitones. The bend has to pass
+// PitchBendThreshold cents to reach the next semitone.
+func (app *application) bendOffset(status *pitchBendStatus, lsb, msb uint8) int {
+	cents := (int(msb)<<7 | int(lsb) - 0x2000) * status.rangeCents / 0x2000
+	sign := 1
+	if cents < 0 {
+		cents, sign = -cents, -1
+	}
+	if cents < app.PitchBendThreshold {
+		return 0
+	}
+	return sign * ((cents-app.PitchBendThreshold)/100 + 1)
+}
+
+// applyPitchBend plays the held notes of the channel again at the bent pitch.
+// With the "glide" policy, every semitone in between is played as well, and
+// the skill cooldown spaces them apart.
+func (app *application) applyPitchBend(event *midiQueueEvent, status *pitchBendStatus) {
+	offset := app.bendOffset(status, event.Message[1], event.Message[2])
+	if offset == status.offset {
+		return
+	}
+	if event.FastForward {
+		status.offset = offset
+		return
+	}
+	steps := []int{offset}
+	if app.PitchBendPolicy == "glide" {
+		steps = steps[:0]
+		for i := status.offset; i != offset; {
+			if i < offset {
+				i++
+			} else {
+				i--
+			}
+			steps = append(steps, i)
+		}
+	}
+	channel := event.Message[0] & 0xf
+	maxLatency := app.PlaybackMaxLatency
+	if event.Realtime {
+		maxLatency = app.RealtimeMaxLatency
+	}
+	for i, step := range steps {
+		status.offset = step
+		var expiry time.Time
+		if !event.Time.IsZero() {
+			expiry = event.Time.Add(maxLatency + time.Duration(i)*app.SkillCooldown)
+		}
+		for note := range status.notes {
+			if !status.notes[note].held {
+				continue
+			}
+			app.addMidiEvent(&midiQueueEvent{
+				Time:              event.Time,
+				Message:           []byte{0x80 | channel, uint8(note), 0x00},
+				Realtime:          event.Realtime,
+				AlreadyTransposed: event.AlreadyTransposed,
+				OutOfRangePolicy:  event.OutOfRangePolicy,
+				Generation:        event.Generation,
+			})
+			app.addMidiEvent(&midiQueueEvent{
+				Time:              event.Time,
+				Expiry:            expiry,
+				Message:           []byte{0x90 | channel, uint8(note), status.notes[note].velocity},
+				Realtime:          event.Realtime,
+				AlreadyTransposed: event.AlreadyTransposed,
+				OutOfRangePolicy:  event.OutOfRangePolicy,
+				Generation:        event.Generation,
+			})
+		}
+	}
+}
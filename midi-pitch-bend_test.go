@@ -0,0 +1,117 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBendOffset(t *testing.T) {
+	for _, test := range []struct {
+		threshold  int
+		rangeCents int
+		value      int
+		want       int
+	}{
+		{50, 200, 0x2000, 0},
+		{50, 200, 0x3fff, 2},
+		{50, 200, 0x0000, -2},
+		// With a range of 0x2000 cents, the value is the bend in cents
+		{50, 0x2000, 0x2000 + 49, 0},
+		{50, 0x2000, 0x2000 + 50, 1},
+		{50, 0x2000, 0x2000 + 149, 1},
+		{50, 0x2000, 0x2000 + 150, 2},
+		{50, 0x2000, 0x2000 - 49, 0},
+		{50, 0x2000, 0x2000 - 50, -1},
+		{1, 0x2000, 0x2000 + 1, 1},
+		{100, 200, 0x3fff, 1},
+		{50, 1200, 0x3fff, 12},
+	} {
+		app := &application{preset: defaultPreset}
+		app.PitchBendThreshold = test.threshold
+		status := newPitchBendStatus()
+		status.rangeCents = test.rangeCents
+		got := app.bendOffset(&status, uint8(test.value&0x7f), uint8(test.value>>7))
+		if got != test.want {
+			t.Errorf("threshold %d, range %d, value %#04x: got %d, want %d", test.threshold, test.rangeCents, test.value, got, test.want)
+		}
+	}
+}
+
+func TestPitchBendRange(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		controllers [][2]uint8
+		want        int
+	}{
+		{"default", nil, 200},
+		{"RPN 0", [][2]uint8{{0x65, 0}, {0x64, 0}, {0x06, 12}}, 1200},
+		{"RPN 0 with cents", [][2]uint8{{0x65, 0}, {0x64, 0}, {0x06, 12}, {0x26, 50}}, 1250},
+		{"cents first", [][2]uint8{{0x64, 0}, {0x65, 0}, {0x26, 50}, {0x06, 1}}, 150},
+		{"no RPN selected", [][2]uint8{{0x06, 12}}, 200},
+		{"RPN 1", [][2]uint8{{0x65, 0}, {0x64, 1}, {0x06, 12}}, 200},
+		{"RPN null", [][2]uint8{{0x65, 0}, {0x64, 0}, {0x65, 0x7f}, {0x64, 0x7f}, {0x06, 12}}, 200},
+		{"reset all controllers", [][2]uint8{{0x65, 0}, {0x64, 0}, {0x79, 0}, {0x06, 12}}, 200},
+	} {
+		status := newPitchBendStatus()
+		for _, cc := range test.controllers {
+			status.controlChange(cc[0], cc[1])
+		}
+		if status.rangeCents != test.want {
+			t.Errorf("%s: got %d cents, want %d", test.name, status.rangeCents, test.want)
+		}
+	}
+}
+
+func TestPitchBendPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		want   []string
+	}{
+		{"ignore", []string{"+'Q'", "-'Q'"}},
+		// Bent up 2 semitones from C4 to D4, and back
+		{"step", []string{"+'Q'", "-'Q'", "+'W'", "-'W'", "+'Q'", "-'Q'"}},
+		{"glide", []string{"+'Q'", "-'Q'", "+'2'", "-'2'", "+'W'", "-'W'", "+'2'", "-'2'", "+'Q'", "-'Q'"}},
+	} {
+		s := newSimulation(t, defaultPreset)
+		s.app.PitchBendPolicy = test.policy
+		s.send(0x90, 0x3c, 0x40)
+		s.run(200 * time.Millisecond)
+		s.send(0xe0, 0x7f, 0x7f)
+		s.run(500 * time.Millisecond)
+		s.send(0xe0, 0x00, 0x40)
+		s.run(500 * time.Millisecond)
+		s.send(0x80, 0x3c, 0x00)
+		s.run(200 * time.Millisecond)
+		// Released notes are not played again
+		s.send(0xe0, 0x7f, 0x7f)
+		s.run(500 * time.Millisecond)
+		got := s.takeKeys()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got keys %q, want %q", test.policy, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// allMidiChannels selects every channel in MidiPlaybackChannels.
+const allMidiChannels = 0xffff
+
+// midiPlaybackEvent is an event of one of the selected tracks, with its time
+// from the beginning of the song.
+type midiPlaybackEvent struct {
+	Progress time.Duration
+	Event    midimark.Event
+}
+
+// mergeMidiTracks merges the events of the selected tracks by time, so a
+// solo performer can play several parts at once. Channel messages are kept
+// only if their channel is selected in the channels bitmask.
+func mergeMidiTracks(sequence *midimark.Sequence, tracks []uint16, channels uint16) ([]midiPlaybackEvent, error) {
+	if sequence == nil {
+		return nil, fmt.Errorf("no MIDI file loaded")
+	}
+	if len(sequence.Tracks) == 0 {
+		return nil, fmt.Errorf("MIDI file contains no track")
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no track selected")
+	}
+	selected := make([]bool, len(sequence.Tracks))
+	order := []int{}
+	for _, track := range tracks {
+		index := int(track)
+		if len(sequence.Tracks) == 1 {
+			index = 0
+		}
+		if index >= len(sequence.Tracks) {
+			return nil, fmt.Errorf("invalid track number (%d), max %d", track, len(sequence.Tracks)-1)
+		}
+		if !selected[index] {
+			selected[index] = true
+			order = append(order, index)
+		}
+	}
+
+	events := []midiPlaybackEvent{}
+	for _, index := range order {
+		thisTrack := sequence.Tracks[index]
+		for _, event := range thisTrack.Events {
+			if status := event.Status(); status >= 0x80 && status < 0xf0 && channels&(1<<(status&0x0f)) == 0 {
+				continue
+			}
+			events = append(events, midiPlaybackEvent{
+				Progress: thisTrack.ConvertAbsTickToDuration(event.Common().AbsTick),
+				Event:    event,
+			})
+		}
+	}
+	if len(order) > 1 {
+		// A note released by one track and pressed by another at the same
+		// time should be pressed again, not released
+		sort.SliceStable(events, func(i, j int) bool {
+			if events[i].Progress != events[j].Progress {
+				return events[i].Progress < events[j].Progress
+			}
+			return !isMidiNoteOn(events[i].Event) && isMidiNoteOn(events[j].Event)
+		})
+	}
+	return events, nil
+}
+
+func equalMidiTrackLists(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isMidiNoteOn(event midimark.Event) bool {
+	noteOn, ok := event.(*midimark.EventNoteOn)
+	return ok && noteOn.Velocity != 0
+}
+
+// parseMidiTrackList accepts track numbers separated by commas or spaces.
+func parseMidiTrackList(s string) ([]uint16, error) {
+	tracks := []uint16{}
+	for _, field := range strings.FieldsFunc(s, isListSeparator) {
+		track, err := strconv.ParseUint(field, 0, 16)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, uint16(track))
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no track selected")
+	}
+	return tracks, nil
+}
+
+// parseMidiChannelList accepts channel numbers from 1 to 16 separated by
+// commas or spaces. An empty list or "all" selects every channel.
+func parseMidiChannelList(s string) (uint16, error) {
+	fields := strings.FieldsFunc(s, isListSeparator)
+	if len(fields) == 0 || (len(fields) == 1 && strings.ToLower(fields[0]) == "all") {
+		return allMidiChannels, nil
+	}
+	channels := uint16(0)
+	for _, field := range fields {
+		channel, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return 0, err
+		}
+		if channel < 1 || channel > 16 {
+			return 0, fmt.Errorf("MIDI channel %d out of range", channel)
+		}
+		channels |= 1 << (channel - 1)
+	}
+	return channels, nil
+}
+
+// midiChannelList lists the channels in the bitmask, numbered from 1.
+func midiChannelList(channels uint16) []int {
+	list := []int{}
+	for i := 0; i < 16; i++ {
+		if channels&(1<<uint(i)) != 0 {
+			list = append(list, i+1)
+		}
+	}
+	return list
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t'
+}
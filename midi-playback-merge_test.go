@@ -0,0 +1,101 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeMidiTracks(t *testing.T) {
+	// 960 ticks per second
+	sequence := decodeTestMidiFile(t, 1, nil, []testMidiEvent{
+		{0, []byte{0x90, 0x3c, 0x40}},
+		{240, []byte{0x91, 0x40, 0x40}},
+		{480, []byte{0x80, 0x3c, 0x00}},
+		{720, []byte{0x81, 0x40, 0x00}},
+	}, []testMidiEvent{
+		{0, []byte{0x92, 0x43, 0x40}},
+		{480, []byte{0x90, 0x3c, 0x40}},
+		{960, []byte{0x80, 0x3c, 0x00}},
+	})
+	for _, test := range []struct {
+		tracks   []uint16
+		channels uint16
+		want     []string
+	}{
+		{[]uint16{1}, allMidiChannels, []string{"0 90 3c 40", "250 91 40 40", "500 80 3c 00", "750 81 40 00"}},
+		// C4 released by track 1 and pressed by track 2 at 500ms is pressed
+		// again, whatever the order of the tracks
+		{[]uint16{2, 1}, allMidiChannels, []string{"0 92 43 40", "0 90 3c 40", "250 91 40 40", "500 80 3c 00", "500 90 3c 40", "750 81 40 00", "1000 80 3c 00"}},
+		{[]uint16{1, 2}, allMidiChannels, []string{"0 90 3c 40", "0 92 43 40", "250 91 40 40", "500 80 3c 00", "500 90 3c 40", "750 81 40 00", "1000 80 3c 00"}},
+		// Channels 1, and 2 and 3
+		{[]uint16{1, 2}, 0x0001, []string{"0 90 3c 40", "500 80 3c 00", "500 90 3c 40", "1000 80 3c 00"}},
+		{[]uint16{1, 2}, 0x0006, []string{"0 92 43 40", "250 91 40 40", "750 81 40 00"}},
+		{[]uint16{2}, 0x0000, []string{}},
+		// Repeated tracks are merged once
+		{[]uint16{1, 1, 1}, allMidiChannels, []string{"0 90 3c 40", "250 91 40 40", "500 80 3c 00", "750 81 40 00"}},
+		{[]uint16{1, 2, 1, 2}, 0x0006, []string{"0 92 43 40", "250 91 40 40", "750 81 40 00"}},
+		{[]uint16{0}, allMidiChannels, []string{}},
+		// Errors
+		{[]uint16{3}, allMidiChannels, nil},
+		{[]uint16{1, 3}, allMidiChannels, nil},
+		{[]uint16{}, allMidiChannels, nil},
+	} {
+		events, err := mergeMidiTracks(sequence, test.tracks, test.channels)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("tracks %v: got no error", test.tracks)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tracks %v: %v", test.tracks, err)
+			continue
+		}
+		got := []string{}
+		for _, event := range events {
+			// Meta events, such as the end of track
+			if event.Event.Status() >= 0xf0 {
+				continue
+			}
+			message, err := event.Event.EncodeRealtime()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%d % x", event.Progress/time.Millisecond, message))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tracks %v channels %#04x:\n got: %s\nwant: %s", test.tracks, test.channels, strings.Join(got, ", "), strings.Join(test.want, ", "))
+		}
+	}
+
+	if _, err := mergeMidiTracks(nil, []uint16{1}, allMidiChannels); err == nil {
+		t.Error("merged tracks without a MIDI file")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/m13253/midimark"
+)
+
+// splitMidiChannels splits the only track of a format-0 file into virtual
+// tracks, one per channel, so that they can be selected like the tracks of
+// a format-1 file. Virtual track 0 keeps the events without a channel, such
+// as tempo changes. Files with only one channel are returned unchanged.
+func splitMidiChannels(sequence *midimark.Sequence) *midimark.Sequence {
+	if sequence.Header == nil || sequence.Header.Format != 0 || len(sequence.Tracks) != 1 {
+		return sequence
+	}
+	thisTrack := sequence.Tracks[0]
+	var channelEvents [16][]midimark.Event
+	programs := [16]int{-1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
+	commonEvents := []midimark.Event{}
+	for _, event := range thisTrack.Events {
+		status := event.Status()
+		if status < 0x80 || status >= 0xf0 {
+			commonEvents = append(commonEvents, event)
+			continue
+		}
+		channel := status & 0x0f
+		// midimark numbers programs from 1
+		if programChange, ok := event.(*midimark.EventProgramChange); ok && programs[channel] < 0 {
+			programs[channel] = int(programChange.Program) - 1
+		}
+		channelEvents[channel] = append(channelEvents[channel], event)
+	}
+	channelCount := 0
+	for _, events := range channelEvents {
+		if len(events) != 0 {
+			channelCount++
+		}
+	}
+	if channelCount < 2 {
+		return sequence
+	}
+
+	tracks := []*midimark.MTrk{{
+		FilePosition: thisTrack.FilePosition,
+		TempoTable:   thisTrack.TempoTable,
+		Events:       commonEvents,
+	}}
+	for channel, events := range channelEvents {
+		if len(events) == 0 {
+			continue
+		}
+		name := &midimark.MetaEventSequenceTrackName{
+			Text: fmt.Sprintf("Channel %d: %s", channel+1, midiProgramName(channel, programs[channel])),
+		}
+		tracks = append(tracks, &midimark.MTrk{
+			FilePosition: thisTrack.FilePosition,
+			TempoTable:   thisTrack.TempoTable,
+			Events:       append([]midimark.Event{name}, events...),
+		})
+	}
+	header := *sequence.Header
+	header.NTrks = uint16(len(tracks))
+	return &midimark.Sequence{
+		Header:    &header,
+		Tracks:    tracks,
+		Undecoded: sequence.Undecoded,
+	}
+}
+
+// midiTrackName returns the name in the first track name event, or an empty
+// string.
+func midiTrackName(thisTrack *midimark.MTrk) string {
+	for _, event := range thisTrack.Events {
+		if trackName, ok := event.(*midimark.MetaEventSequenceTrackName); ok {
+			return trackName.Text
+		}
+	}
+	return ""
+}
+
+// midiProgramName returns the General MIDI name of the program, which is -1
+// if the channel has no program change.
+func midiProgramName(channel, program int) string {
+	if channel == 9 {
+		return "Percussion"
+	}
+	if program < 0 {
+		program = 0
+	}
+	return gmProgramNames[program&0x7f]
+}
+
+var gmProgramNames = [128]string{
+	// Piano
+	"Acoustic Grand Piano", "Bright Acoustic Piano", "Electric Grand Piano", "Honky-tonk Piano",
+	"Electric Piano 1", "Electric Piano 2", "Harpsichord", "Clavinet",
+	// Chromatic Percussion
+	"Celesta", "Glockenspiel", "Music Box", "Vibraphone",
+	"Marimba", "Xylophone", "Tubular Bells", "Dulcimer",
+	// Organ
+	"Drawbar Organ", "Percussive Organ", "Rock Organ", "Church Organ",
+	"Reed Organ", "Accordion", "Harmonica", "Tango Accordion",
+	// Guitar
+	"Acoustic Guitar (nylon)", "Acoustic Guitar (steel)", "Electric Guitar (jazz)", "Electric Guitar (clean)",
+	"Electric Guitar (muted)", "Overdriven Guitar", "Distortion Guitar", "Guitar Harmonics",
+	// Bass
+	"Acoustic Bass", "Electric Bass (finger)", "Electric Bass (pick)", "Fretless Bass",
+	"Slap Bass 1", "Slap Bass 2", "Synth Bass 1", "Synth Bass 2",
+	// Strings
+	"Violin", "Viola", "Cello", "Contrabass",
+	"Tremolo Strings", "Pizzicato Strings", "Orchestral Harp", "Timpani",
+	// Ensemble
+	"String Ensemble 1", "String Ensemble 2", "Synth Strings 1", "Synth Strings 2",
+	"Choir Aahs", "Voice Oohs", "Synth Voice", "Orchestra Hit",
+	// Brass
+	"Trumpet", "Trombone", "Tuba", "Muted Trumpet",
+	"French Horn", "Brass Section", "Synth Brass 1", "Synth Brass 2",
+	// Reed
+	"Soprano Sax", "Alto Sax", "Tenor Sax", "Baritone Sax",
+	"Oboe", "English Horn", "Bassoon", "Clarinet",
+	// Pipe
+	"Piccolo", "Flute", "Recorder", "Pan Flute",
+	"Blown Bottle", "Shakuhachi", "Whistle", "Ocarina",
+	// Synth Lead
+	"Lead 1 (square)", "Lead 2 (sawtooth)", "Lead 3 (calliope)", "Lead 4 (chiff)",
+	"Lead 5 (charang)", "Lead 6 (voice)", "Lead 7 (fifths)", "Lead 8 (bass + lead)",
+	// Synth Pad
+	"Pad 1 (new age)", "Pad 2 (warm)", "Pad 3 (polysynth)", "Pad 4 (choir)",
+	"Pad 5 (bowed)", "Pad 6 (metallic)", "Pad 7 (halo)", "Pad 8 (sweep)",
+	// Synth Effects
+	"FX 1 (rain)", "FX 2 (soundtrack)", "FX 3 (crystal)", "FX 4 (atmosphere)",
+	"FX 5 (brightness)", "FX 6 (goblins)", "FX 7 (echoes)", "FX 8 (sci-fi)",
+	// Ethnic
+	"Sitar", "Banjo", "Shamisen", "Koto",
+	"Kalimba", "Bagpipe", "Fiddle", "Shanai",
+	// Percussive
+	"Tinkle Bell", "Agogo", "Steel Drums", "Woodblock",
+	"Taiko Drum", "Melodic Tom", "Synth Drum", "Reverse Cymbal",
+	// Sound Effects
+	"Guitar Fret Noise", "Breath Noise", "Seashore", "Bird Tweet",
+	"Telephone Ring", "Helicopter", "Applause", "Gunshot",
+}
@@ -0,0 +1,164 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/m13253/midimark"
+)
+
+// testFormat0File has a tempo change, a piano on channel 1, a violin on
+// channel 2 and drums on channel 10.
+var testFormat0File = []testMidiEvent{
+	{0, []byte{0xff, 0x51, 0x03, 0x07, 0xa1, 0x20}},
+	{0, []byte{0xc1, 40}},
+	{0, []byte{0x90, 0x3c, 0x40}},
+	{0, []byte{0x91, 0x40, 0x40}},
+	{0, []byte{0x99, 0x24, 0x40}},
+	{480, []byte{0x80, 0x3c, 0x00}},
+	{480, []byte{0x81, 0x40, 0x00}},
+	{480, []byte{0x89, 0x24, 0x00}},
+	{960, []byte{0xff, 0x51, 0x03, 0x0f, 0x42, 0x40}},
+	{960, []byte{0x91, 0x43, 0x40}},
+	{1440, []byte{0x81, 0x43, 0x00}},
+}
+
+func TestSplitMidiChannels(t *testing.T) {
+	sequence := decodeTestMidiFile(t, 0, testFormat0File)
+	split := splitMidiChannels(sequence)
+	if split == sequence {
+		t.Fatal("format 0 file with 3 channels not split")
+	}
+	if split.Header.Format != 0 || split.Header.NTrks != 4 || len(split.Tracks) != 4 {
+		t.Fatalf("got format %d, %d tracks in header, %d tracks", split.Header.Format, split.Header.NTrks, len(split.Tracks))
+	}
+
+	names := []string{}
+	for _, thisTrack := range split.Tracks {
+		names = append(names, midiTrackName(thisTrack))
+	}
+	if want := []string{"", "Channel 1: Acoustic Grand Piano", "Channel 2: Violin", "Channel 10: Percussion"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got names %q, want %q", names, want)
+	}
+
+	for i, want := range []struct {
+		channel int
+		events  int
+	}{
+		// Both tempo changes and the end of track
+		{-1, 3},
+		{0, 3},
+		{1, 6},
+		{9, 3},
+	} {
+		thisTrack := split.Tracks[i]
+		if thisTrack.TempoTable != sequence.Tracks[0].TempoTable {
+			t.Errorf("track %d: tempo table not shared", i)
+		}
+		if len(thisTrack.Events) != want.events {
+			t.Errorf("track %d: got %d events, want %d", i, len(thisTrack.Events), want.events)
+		}
+		for j, event := range thisTrack.Events {
+			if _, ok := event.(*midimark.MetaEventSequenceTrackName); ok && j == 0 && i != 0 {
+				continue
+			}
+			status := event.Status()
+			channel := -1
+			if status >= 0x80 && status < 0xf0 {
+				channel = int(status & 0x0f)
+			}
+			if channel != want.channel {
+				t.Errorf("track %d: got %T on channel %d, want channel %d", i, event, channel+1, want.channel+1)
+			}
+		}
+	}
+
+	// The second note of the violin comes after the tempo change
+	events, err := mergeMidiTracks(split, []uint16{2}, allMidiChannels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := mergeMidiTracks(sequence, []uint16{0}, allMidiChannels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if _, ok := event.Event.(*midimark.MetaEventSequenceTrackName); ok {
+			continue
+		}
+		found := false
+		for _, mergedEvent := range merged {
+			if mergedEvent.Event == event.Event {
+				found = mergedEvent.Progress == event.Progress
+			}
+		}
+		if !found {
+			t.Errorf("%T at %s is not where it was before the split", event.Event, event.Progress)
+		}
+	}
+
+	for _, unchanged := range []*midimark.Sequence{
+		decodeTestMidiFile(t, 0, []testMidiEvent{testFormat0File[0], testFormat0File[2], testFormat0File[5]}),
+		decodeTestMidiFile(t, 1, testFormat0File[:1], testFormat0File[1:]),
+	} {
+		if splitMidiChannels(unchanged) != unchanged {
+			t.Errorf("format %d file with %d tracks was split", unchanged.Header.Format, len(unchanged.Tracks))
+		}
+	}
+}
+
+func TestSplitMidiChannelsSelection(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+	err := s.app.setMidiPlaybackFile(bytes.NewReader(encodeTestMidiFile(0, testFormat0File)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{1, 2, 3}; !reflect.DeepEqual(s.app.MidiPlaybackTracks, want) {
+		t.Errorf("got tracks %v, want %v", s.app.MidiPlaybackTracks, want)
+	}
+
+	// The next file starts over with track 1, it has no track 3
+	s.app.midiFileBuffer.nextEventIndex = 5
+	err = s.app.setMidiPlaybackFile(bytes.NewReader(encodeTestMidiFile(1, testFormat0File[:1], testFormat0File[1:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{1}; !reflect.DeepEqual(s.app.MidiPlaybackTracks, want) {
+		t.Errorf("got tracks %v after loading a format 1 file, want %v", s.app.MidiPlaybackTracks, want)
+	}
+	if s.app.midiFileBuffer.nextEventIndex != 0 {
+		t.Errorf("got next event %d after loading a format 1 file, want 0", s.app.midiFileBuffer.nextEventIndex)
+	}
+	events, err := mergeMidiTracks(s.app.midiFileBuffer.sequence, s.app.MidiPlaybackTracks, s.app.MidiPlaybackChannels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All but the tempo change, and the end of track
+	if len(events) != len(testFormat0File) {
+		t.Errorf("got %d events from track 1, want %d", len(events), len(testFormat0File))
+	}
+}
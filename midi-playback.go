@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -30,16 +28,27 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	cgc "github.com/m13253/cgc-go"
 	"github.com/m13253/midimark"
 )
 
+const (
+	minMidiPlaybackSpeed = 0.25
+	maxMidiPlaybackSpeed = 4.0
+)
+
 type midiFileBuffer struct {
-	sequence       *midimark.Sequence
+	sequence *midimark.Sequence
+	// Merged from the selected tracks when playback starts, nil if the
+	// selection or the file has changed since
+	events         []midiPlaybackEvent
 	nextEventIndex int
-	nextEventTimer *time.Timer
+	nextEventTimer clockTimer
 	fastForward    bool
 }
 
@@ -48,9 +57,7 @@ func (app *application) warningCallback(err error) {
 }
 
 func (app *application) processMidiPlayback() {
-	app.midiFileBuffer = &midiFileBuffer{
-		nextEventTimer: time.NewTimer(0),
-	}
+	app.initMidiPlayback()
 	for {
 		select {
 		case r, ok := <-app.MidiPlaybackGoro:
@@ -58,7 +65,7 @@ func (app *application) processMidiPlayback() {
 				return
 			}
 			cgc.RunOneRequest(app.ctx, r)
-		case now := <-app.midiFileBuffer.nextEventTimer.C:
+		case now := <-app.midiFileBuffer.nextEventTimer.C():
 			app.playNextMidiEvent(now)
 		case <-app.ctx.Done():
 			return
@@ -66,6 +73,12 @@ func (app *application) processMidiPlayback() {
 	}
 }
 
+func (app *application) initMidiPlayback() {
+	app.midiFileBuffer = &midiFileBuffer{
+		nextEventTimer: app.clock.NewTimer(0),
+	}
+}
+
 func (app *application) setMidiPlaybackFile(midiFile io.ReadSeeker) error {
 	var err error
 
@@ -73,7 +86,22 @@ func (app *application) setMidiPlaybackFile(midiFile io.ReadSeeker) error {
 	if err != nil {
 		return err
 	}
+	// The tracks selected for the last file may not exist in this one
+	tracks := []uint16{1}
+	if split := splitMidiChannels(sequence); split != sequence {
+		log.Printf("Format 0 MIDI file split into %d channels, all of them selected.\n", len(split.Tracks)-1)
+		sequence = split
+		// As the single track did, play every channel until some are selected
+		tracks = make([]uint16, len(sequence.Tracks)-1)
+		for i := range tracks {
+			tracks[i] = uint16(i + 1)
+		}
+	}
+	app.MidiPlaybackTracks = tracks
 	app.midiFileBuffer.sequence = sequence
+	app.midiFileBuffer.events = nil
+	app.midiFileBuffer.nextEventIndex = 0
+	app.requestAutoTranspose()
 	return nil
 }
 
@@ -81,37 +109,35 @@ func (app *application) playNextMidiEvent(now time.Time) {
 	if !app.MidiPlaybackScheduleEnabled {
 		return
 	}
-	track := app.MidiPlaybackTrack
-	if len(app.midiFileBuffer.sequence.Tracks) == 0 {
-		log.Println("MIDI file contains no track.")
-		return
-	}
-	if len(app.midiFileBuffer.sequence.Tracks) == 1 {
-		track = 0
-	}
-	if int(track) >= len(app.midiFileBuffer.sequence.Tracks) {
-		log.Printf("Invalid track number (%d), max %d.\n", app.MidiPlaybackTrack, len(app.midiFileBuffer.sequence.Tracks)-1)
-		return
+	if app.midiFileBuffer.events == nil {
+		events, err := mergeMidiTracks(app.midiFileBuffer.sequence, app.MidiPlaybackTracks, app.MidiPlaybackChannels)
+		if err != nil {
+			log.Println("Error: ", err)
+			return
+		}
+		app.midiFileBuffer.events = events
 	}
-	playbackProgress := now.Add(app.NtpClockOffset).Add(app.MidiPlaybackOffset).Add(app.ModifierCooldown).Sub(app.MidiPlaybackSchedule)
-	if playbackProgress < 0 {
+	events := app.midiFileBuffer.events
+	elapsed := now.Add(app.snapshotNtp().ClockOffset).Add(app.MidiPlaybackOffset).Add(app.ModifierCooldown).Sub(app.MidiPlaybackSchedule)
+	if elapsed < 0 {
 		app.midiFileBuffer.nextEventIndex = 0
-		app.midiFileBuffer.nextEventTimer.Reset(-playbackProgress)
+		app.midiFileBuffer.nextEventTimer.Reset(-elapsed)
 		if app.midiFileBuffer.fastForward {
 			log.Println("Fast-forward off.")
 			app.midiFileBuffer.fastForward = false
 		}
 		return
 	}
+	// Everything below is measured in the MIDI file, not on the wall clock
+	playbackProgress := app.midiPlaybackSongTime(elapsed)
 	if app.MidiPlaybackLoopEnabled && app.MidiPlaybackLoop > 0 {
 		playbackProgress %= app.MidiPlaybackLoop
 	}
 	index := app.midiFileBuffer.nextEventIndex
-	thisTrack := app.midiFileBuffer.sequence.Tracks[track]
-	if index >= len(thisTrack.Events) {
+	if index >= len(events) {
 		if app.MidiPlaybackLoopEnabled {
 			app.midiFileBuffer.nextEventIndex = 0
-			waitTime := app.MidiPlaybackLoop - playbackProgress
+			waitTime := app.midiPlaybackWallTime(app.MidiPlaybackLoop - playbackProgress)
 			if waitTime < 0 {
 				waitTime = 0
 			}
@@ -131,33 +157,39 @@ func (app *application) playNextMidiEvent(now time.Time) {
 		return
 	}
 	if index > 0 {
-		lastNoteProgress := thisTrack.ConvertAbsTickToDuration(thisTrack.Events[index-1].Common().AbsTick)
+		lastNoteProgress := events[index-1].Progress
 		if lastNoteProgress > playbackProgress {
 			app.resetMidiPlayback()
 			return
 		}
 	}
-	nextNoteProgress := thisTrack.ConvertAbsTickToDuration(thisTrack.Events[index].Common().AbsTick)
+	nextNoteProgress := events[index].Progress
 	if nextNoteProgress > playbackProgress {
-		app.midiFileBuffer.nextEventTimer.Reset(nextNoteProgress - playbackProgress)
+		app.midiFileBuffer.nextEventTimer.Reset(app.midiPlaybackWallTime(nextNoteProgress - playbackProgress))
 		if app.midiFileBuffer.fastForward {
 			log.Println("Fast-forward off.")
 			app.midiFileBuffer.fastForward = false
 		}
 		return
 	}
-	message, err := thisTrack.Events[index].EncodeRealtime()
+	message, err := events[index].Event.EncodeRealtime()
 	if err != nil {
 		log.Println(err)
 		// fall-through
 	}
 	if len(message) != 0 {
-		app.addMidiEvent(&midiQueueEvent{
-			Time:              now.Add(-playbackProgress).Add(nextNoteProgress),
+		event := &midiQueueEvent{
+			Time:              now.Add(-app.midiPlaybackWallTime(playbackProgress - nextNoteProgress)),
 			Message:           message,
 			Realtime:          false,
 			FastForward:       app.midiFileBuffer.fastForward,
 			AlreadyTransposed: true,
+			OutOfRangePolicy:  app.MidiPlaybackOutOfRangePolicy,
+			Generation:        atomic.LoadUint32(&app.midiGeneration),
+		}
+		_ = app.MidiRealtimeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+			app.addMidiEvent(event)
+			return nil, nil
 		})
 	}
 	app.midiFileBuffer.nextEventIndex = index + 1
@@ -165,31 +197,109 @@ func (app *application) playNextMidiEvent(now time.Time) {
 }
 
 func (app *application) setMidiPlaybackTrack(trackNumber uint16) {
-	if app.MidiPlaybackTrack == trackNumber {
+	app.setMidiPlaybackTracks([]uint16{trackNumber})
+}
+
+// setMidiPlaybackTracks selects the tracks to be merged into one
+// performance.
+func (app *application) setMidiPlaybackTracks(tracks []uint16) {
+	if equalMidiTrackLists(app.MidiPlaybackTracks, tracks) {
 		return
 	}
-	app.MidiPlaybackTrack = trackNumber
+	app.MidiPlaybackTracks = tracks
+	app.midiFileBuffer.events = nil
 	app.resetMidiPlayback()
+	app.requestAutoTranspose()
 }
 
-func (app *application) setMidiPlaybackOffset(offset time.Duration) {
-	fmt.Printf("Set playback offset to %s.\n", offset)
-	app.MidiPlaybackOffset = offset
-	track := app.MidiPlaybackTrack
-	if len(app.midiFileBuffer.sequence.Tracks) == 1 {
-		track = 0
+// stepMidiPlaybackTracks moves every selected track by delta, unless one of
+// them would move past the first or the last track of the file.
+func (app *application) stepMidiPlaybackTracks(delta int) {
+	last := 0xffff
+	if sequence := app.midiFileBuffer.sequence; sequence != nil {
+		last = len(sequence.Tracks) - 1
+	}
+	tracks := make([]uint16, len(app.MidiPlaybackTracks))
+	names := make([]string, len(app.MidiPlaybackTracks))
+	for i, track := range app.MidiPlaybackTracks {
+		next := int(track) + delta
+		if next < 0 || next > last {
+			return
+		}
+		tracks[i] = uint16(next)
+		names[i] = fmt.Sprintf("#%d", next)
 	}
-	if int(track) >= len(app.midiFileBuffer.sequence.Tracks) {
+	log.Printf("Playback track changed to %s.\n", strings.Join(names, ", "))
+	app.setMidiPlaybackTracks(tracks)
+}
+
+// setMidiPlaybackChannels selects the channels to be played from the
+// selected tracks, as a bitmask.
+func (app *application) setMidiPlaybackChannels(channels uint16) {
+	if app.MidiPlaybackChannels == channels {
 		return
 	}
-	if app.midiFileBuffer.nextEventIndex >= len(app.midiFileBuffer.sequence.Tracks[track].Events) {
+	app.MidiPlaybackChannels = channels
+	app.midiFileBuffer.events = nil
+	app.resetMidiPlayback()
+	app.requestAutoTranspose()
+}
+
+func (app *application) setMidiPlaybackOffset(offset time.Duration) {
+	fmt.Printf("Set playback offset to %s.\n", offset)
+	app.MidiPlaybackOffset = offset
+	if app.midiFileBuffer.nextEventIndex >= len(app.midiFileBuffer.events) {
 		app.midiFileBuffer.nextEventIndex = 0
 	}
 	app.midiFileBuffer.nextEventTimer.Reset(0)
 }
 
-func (app *application) getMidiPlaybackScheduler() (enabled bool, startTime time.Time, loopEnabled bool, loopInterval time.Duration) {
-	return app.MidiPlaybackScheduleEnabled, app.MidiPlaybackSchedule, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop
+// setMidiPlaybackSpeed scales the tempo of the MIDI file. The start time and
+// the offset stay on the wall clock, so players who choose the same speed
+// stay in sync, while the loop interval stretches with the music.
+func (app *application) setMidiPlaybackSpeed(speed float64) error {
+	err := checkMidiPlaybackSpeed(speed)
+	if err != nil {
+		return err
+	}
+	if app.MidiPlaybackSpeed == speed {
+		return nil
+	}
+	fmt.Printf("Set playback speed to %g.\n", speed)
+	app.MidiPlaybackSpeed = speed
+	app.resetMidiPlayback()
+	return nil
+}
+
+func checkMidiPlaybackSpeed(speed float64) error {
+	if !(speed >= minMidiPlaybackSpeed && speed <= maxMidiPlaybackSpeed) {
+		return fmt.Errorf("playback speed %g is out of range %g - %g", speed, minMidiPlaybackSpeed, maxMidiPlaybackSpeed)
+	}
+	return nil
+}
+
+// midiPlaybackSongTime converts time elapsed on the wall clock into progress
+// in the MIDI file.
+func (app *application) midiPlaybackSongTime(d time.Duration) time.Duration {
+	if app.MidiPlaybackSpeed == 1 {
+		return d
+	}
+	return time.Duration(float64(d) * app.MidiPlaybackSpeed)
+}
+
+// midiPlaybackWallTime converts progress in the MIDI file into time on the
+// wall clock, rounded up so the timer never fires before the event.
+func (app *application) midiPlaybackWallTime(d time.Duration) time.Duration {
+	if app.MidiPlaybackSpeed == 1 {
+		return d
+	}
+	return time.Duration(math.Ceil(float64(d) / app.MidiPlaybackSpeed))
+}
+
+// setMidiPlaybackOutOfRangePolicy overrides OutOfRangePolicy for playback,
+// an empty policy restores the configured one.
+func (app *application) setMidiPlaybackOutOfRangePolicy(policy string) {
+	app.MidiPlaybackOutOfRangePolicy = policy
 }
 
 func (app *application) setMidiPlaybackScheduler(enabled bool, startTime time.Time, loopEnabled bool, loopInterval time.Duration) {
@@ -0,0 +1,178 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// midiInHandler receives one complete MIDI message from an input port, either
+// a short message or a whole SysEx message.
+//
+// It may be called from any goroutine.
+type midiInHandler func(message []byte)
+
+// midiDriver enumerates and opens MIDI ports of one transport.
+type midiDriver interface {
+	ListInputs() []string
+	ListOutputs() []string
+	OpenInput(index int, handler midiInHandler) (midiInPort, error)
+	OpenOutput(index int) (midiOutPort, error)
+}
+
+type midiInPort interface {
+	Close() error
+}
+
+type midiOutPort interface {
+	Send(message []byte) error
+	Close() error
+}
+
+// loopbackMidiDriver provides virtual ports, anything sent to an output port
+// is delivered to the input port it is connected to.
+type loopbackMidiDriver struct {
+	names []string
+	ports []*loopbackMidiPort
+	peers []int
+}
+
+// loopbackMidiPort is the receiving end of a virtual port. While the input
+// port is open, a goroutine delivers the queued messages to its handler.
+type loopbackMidiPort struct {
+	mutex sync.Mutex
+	queue chan []byte
+}
+
+type loopbackMidiInPort struct {
+	port  *loopbackMidiPort
+	queue chan []byte
+}
+
+type loopbackMidiOutPort struct {
+	port *loopbackMidiPort
+}
+
+// newLoopbackMidiDriver connects each output port to the input port with the
+// same index.
+func newLoopbackMidiDriver(names ...string) *loopbackMidiDriver {
+	peers := make([]int, len(names))
+	for i := range peers {
+		peers[i] = i
+	}
+	return newLoopbackMidiDriverWithPeers(names, peers)
+}
+
+// newCrossedLoopbackMidiDriver provides two ports, each output port connected
+// to the other input port, so opening input 0 and output 0 together does not
+// feed MIDI out back into MIDI in.
+func newCrossedLoopbackMidiDriver(nameA, nameB string) *loopbackMidiDriver {
+	return newLoopbackMidiDriverWithPeers([]string{nameA, nameB}, []int{1, 0})
+}
+
+func newLoopbackMidiDriverWithPeers(names []string, peers []int) *loopbackMidiDriver {
+	d := &loopbackMidiDriver{
+		names: names,
+		ports: make([]*loopbackMidiPort, len(names)),
+		peers: peers,
+	}
+	for i := range d.ports {
+		d.ports[i] = new(loopbackMidiPort)
+	}
+	return d
+}
+
+func (d *loopbackMidiDriver) ListInputs() []string {
+	results := make([]string, len(d.names))
+	copy(results, d.names)
+	return results
+}
+
+func (d *loopbackMidiDriver) ListOutputs() []string {
+	results := make([]string, len(d.names))
+	copy(results, d.names)
+	return results
+}
+
+func (d *loopbackMidiDriver) OpenInput(index int, handler midiInHandler) (midiInPort, error) {
+	if index < 0 || index >= len(d.ports) {
+		return nil, fmt.Errorf("invalid loopback MIDI port %d", index)
+	}
+	port := d.ports[index]
+	port.mutex.Lock()
+	defer port.mutex.Unlock()
+	if port.queue != nil {
+		return nil, fmt.Errorf("loopback MIDI port %d is already open", index)
+	}
+	port.queue = make(chan []byte, 256)
+	go port.deliver(port.queue, handler)
+	return &loopbackMidiInPort{port, port.queue}, nil
+}
+
+func (d *loopbackMidiDriver) OpenOutput(index int) (midiOutPort, error) {
+	if index < 0 || index >= len(d.ports) {
+		return nil, fmt.Errorf("invalid loopback MIDI port %d", index)
+	}
+	return &loopbackMidiOutPort{d.ports[d.peers[index]]}, nil
+}
+
+// deliver runs until the input port is closed. Messages still queued at that
+// time are discarded.
+func (p *loopbackMidiPort) deliver(queue chan []byte, handler midiInHandler) {
+	for message := range queue {
+		p.mutex.Lock()
+		open := p.queue == queue
+		p.mutex.Unlock()
+		if open {
+			handler(message)
+		}
+	}
+}
+
+func (p *loopbackMidiInPort) Close() error {
+	p.port.mutex.Lock()
+	if p.port.queue == p.queue {
+		close(p.queue)
+		p.port.queue = nil
+	}
+	p.port.mutex.Unlock()
+	return nil
+}
+
+func (p *loopbackMidiOutPort) Send(message []byte) error {
+	buffer := make([]byte, len(message))
+	copy(buffer, message)
+	p.port.mutex.Lock()
+	defer p.port.mutex.Unlock()
+	// Nobody is listening, drop the message
+	if p.port.queue != nil {
+		p.port.queue <- buffer
+	}
+	return nil
+}
+
+func (p *loopbackMidiOutPort) Close() error {
+	return nil
+}
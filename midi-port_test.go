@@ -0,0 +1,155 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	cgc "github.com/m13253/cgc-go"
+)
+
+func TestLoopbackMidiDriver(t *testing.T) {
+	s := newSimulation(t, defaultPreset)
+	driver := newLoopbackMidiDriver("Loopback A", "Loopback B")
+	s.app.midiDriver = driver
+
+	if _, err := driver.OpenInput(2, nil); err == nil {
+		t.Fatal("opened a port that does not exist")
+	}
+	err := s.app.openMidiInDevice(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.OpenInput(1, nil); err == nil {
+		t.Fatal("opened the same input port twice")
+	}
+	out, err := driver.OpenOutput(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loopback port delivers on its own goroutine
+	receive := func() {
+		t.Helper()
+		select {
+		case r := <-s.app.MidiRealtimeGoro:
+			cgc.RunOneRequest(s.app.ctx, r)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the loopback port")
+		}
+	}
+
+	for _, message := range [][]byte{
+		{0x90, 0x3e, 0x40},
+		{0x80, 0x3e, 0x00},
+		{0x90, 0x32, 0x40},
+		{0x90, 0x32, 0x00},
+	} {
+		err = out.Send(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive()
+		s.run(200 * time.Millisecond)
+	}
+	s.expectKeys(t, "+'W'", "-'W'", "+Ctrl", "+'W'", "-'W'")
+
+	// Nothing is delivered after the input port is closed
+	s.app.closeMidiInDevice()
+	err = out.Send([]byte{0x90, 0x3c, 0x40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.app.MidiRealtimeGoro:
+		t.Fatal("message delivered to a closed port")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCrossedLoopbackMidiDriver(t *testing.T) {
+	driver := newCrossedLoopbackMidiDriver("Loopback A", "Loopback B")
+	received := [2]chan []byte{make(chan []byte, 1), make(chan []byte, 1)}
+	open := func(index int) midiInPort {
+		t.Helper()
+		in, err := driver.OpenInput(index, func(message []byte) {
+			received[index] <- message
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	expect := func(index int, message []byte) {
+		t.Helper()
+		for i := range received {
+			select {
+			case m := <-received[i]:
+				if i != index || string(m) != string(message) {
+					t.Fatalf("input %d received % x, expected % x on input %d", i, m, message, index)
+				}
+			case <-time.After(50 * time.Millisecond):
+				if i == index {
+					t.Fatalf("no message on input %d", index)
+				}
+			}
+		}
+	}
+
+	send := func(out midiOutPort, message []byte) {
+		t.Helper()
+		err := out.Send(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in0, in1 := open(0), open(1)
+	out0, err := driver.OpenOutput(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out1, err := driver.OpenOutput(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Output 0 does not loop back into input 0
+	send(out0, []byte{0x90, 0x3c, 0x40})
+	expect(1, []byte{0x90, 0x3c, 0x40})
+	send(out1, []byte{0x80, 0x3c, 0x00})
+	expect(0, []byte{0x80, 0x3c, 0x00})
+
+	// An input port can be opened again after it is closed
+	in1.Close()
+	in1.Close()
+	send(out0, []byte{0x90, 0x3e, 0x40})
+	expect(-1, nil)
+	in1 = open(1)
+	send(out0, []byte{0x90, 0x40, 0x40})
+	expect(1, []byte{0x90, 0x40, 0x40})
+	in0.Close()
+	in1.Close()
+}
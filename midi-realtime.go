@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -26,14 +24,12 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
-	"runtime"
+	"sync/atomic"
 	"time"
 
-	"github.com/m13253/midi2ffxiv/winmm"
 	cgc "github.com/m13253/cgc-go"
-	"golang.org/x/sys/windows"
 )
 
 type midiQueueEvent struct {
@@ -43,9 +39,32 @@ type midiQueueEvent struct {
 	Realtime          bool
 	FastForward       bool
 	AlreadyTransposed bool
+	Transpose         int
+	OutOfRangePolicy  string
+	ChordResolved     bool
+	Muted             bool
+	Zone              int
+	ChordPolicy       string
+	// Added to Message[1] for a note moved out of 0 - 127, which can only be
+	// played if OutOfRangePolicy brings it back
+	NoteOverflow int
+	// See application.midiGeneration
+	Generation uint32
+}
+
+var midiChannelModes = []string{"on", "off", "mute"}
+
+func isMidiChannelMode(mode string) bool {
+	for _, i := range midiChannelModes {
+		if mode == i {
+			return true
+		}
+	}
+	return false
 }
 
 func (app *application) processMidiRealtime() {
+	app.initRemoteControl()
 	for {
 		select {
 		case r, ok := <-app.MidiRealtimeGoro:
@@ -55,6 +74,9 @@ func (app *application) processMidiRealtime() {
 			cgc.RunOneRequest(app.ctx, r)
 		case nextAction := <-app.midiOutQueue.NextAction():
 			nextEvent := nextAction.Value.(*midiQueueEvent)
+			if app.isStaleMidiEvent(nextEvent) {
+				continue
+			}
 			err := app.sendMidiOutMessage(nextEvent)
 			if err != nil {
 				log.Println("Error: ", err)
@@ -66,23 +88,11 @@ func (app *application) processMidiRealtime() {
 }
 
 func (app *application) listMidiInDevices() []string {
-	midiInDeviceCount := winmm.MidiInGetNumDevs()
-	results := make([]string, midiInDeviceCount)
-	for i := uint32(0); i < midiInDeviceCount; i++ {
-		deviceName, _ := getMidiInDevName(uintptr(i))
-		results[i] = deviceName
-	}
-	return results
+	return app.midiDriver.ListInputs()
 }
 
 func (app *application) listMidiOutDevices() []string {
-	midiOutDeviceCount := winmm.MidiOutGetNumDevs()
-	results := make([]string, midiOutDeviceCount)
-	for i := uint32(0); i < midiOutDeviceCount; i++ {
-		deviceName, _ := getMidiOutDevName(uintptr(i))
-		results[i] = deviceName
-	}
-	return results
+	return app.midiDriver.ListOutputs()
 }
 
 func (app *application) openMidiInDevice(midiInDevice int) error {
@@ -90,41 +100,14 @@ func (app *application) openMidiInDevice(midiInDevice int) error {
 	if midiInDevice < 0 {
 		return nil
 	}
-	midiInDeviceCount := winmm.MidiInGetNumDevs()
-	if midiInDevice >= int(midiInDeviceCount) {
-		return winmm.MidiInError(winmm.MMSYSERR_BADDEVICEID)
-	}
 
-	hMidiIn, err := winmm.MidiInOpen(uint32(midiInDevice), app.hWnd, 0, winmm.CALLBACK_WINDOW|winmm.MIDI_IO_STATUS)
+	midiInPort, err := app.midiDriver.OpenInput(midiInDevice, app.deliverMidiInEvent)
 	if err != nil {
 		return err
 	}
 
-	for i := range app.sysexBuffer {
-		app.sysexBuffer[i] = &winmm.MIDIHDR{
-			LpData:         &new([65536]byte)[0],
-			DwBufferLength: 65536,
-		}
-		err = winmm.MidiInPrepareHeader(hMidiIn, app.sysexBuffer[i])
-		if err != nil {
-			_ = winmm.MidiInClose(hMidiIn)
-			return err
-		}
-		err = winmm.MidiInAddBuffer(hMidiIn, app.sysexBuffer[i])
-		if err != nil {
-			_ = winmm.MidiInClose(hMidiIn)
-			return err
-		}
-	}
-
 	app.MidiInDevice = midiInDevice
-	app.hMidiIn = hMidiIn
-	err = winmm.MidiInStart(app.hMidiIn)
-	if err != nil {
-		app.closeMidiInDevice()
-		return err
-	}
-
+	app.midiInPort = midiInPort
 	return nil
 }
 
@@ -133,18 +116,14 @@ func (app *application) openMidiOutDevice(midiOutDevice int) error {
 	if midiOutDevice < 0 {
 		return nil
 	}
-	MidiOutDeviceCount := winmm.MidiOutGetNumDevs()
-	if midiOutDevice >= int(MidiOutDeviceCount) {
-		return winmm.MidiOutError(winmm.MMSYSERR_BADDEVICEID)
-	}
 
-	hMidiOut, err := winmm.MidiOutOpen(uint32(midiOutDevice), app.hWnd, 0, winmm.CALLBACK_NULL)
+	midiOutPort, err := app.midiDriver.OpenOutput(midiOutDevice)
 	if err != nil {
 		return err
 	}
 
 	app.MidiOutDevice = midiOutDevice
-	app.hMidiOut = hMidiOut
+	app.midiOutPort = midiOutPort
 
 	app.setMidiOutBank(app.MidiOutBank)
 	app.setMidiOutPatch(app.MidiOutPatch)
@@ -153,14 +132,14 @@ func (app *application) openMidiOutDevice(midiOutDevice int) error {
 
 func (app *application) closeMidiInDevice() {
 	app.MidiInDevice = -1
-	if app.hMidiIn == 0 {
+	if app.midiInPort == nil {
 		return
 	}
-	for i := range app.sysexBuffer {
-		_ = winmm.MidiInUnprepareHeader(app.hMidiIn, app.sysexBuffer[i])
+	err := app.midiInPort.Close()
+	if err != nil {
+		log.Println("Error: ", err)
 	}
-	_ = winmm.MidiInClose(app.hMidiIn)
-	app.hMidiIn = 0
+	app.midiInPort = nil
 }
 
 func (app *application) closeMidiOutDevice() {
@@ -168,32 +147,36 @@ func (app *application) closeMidiOutDevice() {
 		Message: []byte{0xb0, 0x7b, 0x00},
 	})
 	app.MidiOutDevice = -1
-	if app.hMidiOut == 0 {
+	if app.midiOutPort == nil {
 		return
 	}
-	hMidiOut := app.hMidiOut
-	app.hMidiOut = 0
-	time.AfterFunc(1*time.Second, func() {
-		_ = winmm.MidiOutClose(hMidiOut)
-	})
+	err := app.midiOutPort.Close()
+	if err != nil {
+		log.Println("Error: ", err)
+	}
+	app.midiOutPort = nil
 }
 
 func (app *application) setMidiOutBank(midiOutBank uint16) {
+	generation := atomic.LoadUint32(&app.midiGeneration)
 	app.keystrokeQueue.AddAction(&midiQueueEvent{
-		Message:  []byte{0xb0, 0x00, uint8(midiOutBank>>15) & 0x7f},
-		Realtime: true,
+		Message:    []byte{0xb0, 0x00, uint8(midiOutBank>>15) & 0x7f},
+		Realtime:   true,
+		Generation: generation,
 	}, time.Time{})
 	app.keystrokeQueue.AddAction(&midiQueueEvent{
-		Message:  []byte{0xb0, 0x20, uint8(midiOutBank) & 0x7f},
-		Realtime: true,
+		Message:    []byte{0xb0, 0x20, uint8(midiOutBank) & 0x7f},
+		Realtime:   true,
+		Generation: generation,
 	}, time.Time{})
 	app.MidiOutBank = midiOutBank
 }
 
 func (app *application) setMidiOutPatch(midiOutPatch uint8) {
 	app.keystrokeQueue.AddAction(&midiQueueEvent{
-		Message:  []byte{0xc0, midiOutPatch & 0x7f},
-		Realtime: true,
+		Message:    []byte{0xc0, midiOutPatch & 0x7f},
+		Realtime:   true,
+		Generation: atomic.LoadUint32(&app.midiGeneration),
 	}, time.Time{})
 	app.MidiOutPatch = midiOutPatch
 }
@@ -203,53 +186,130 @@ func (app *application) setMidiOutTranspose(midiOutTranspose int) {
 	app.MidiOutTranspose = midiOutTranspose
 }
 
+// setMidiSplitZones replaces the split zones, which do not overlap.
+func (app *application) setMidiSplitZones(zones []splitZone) {
+	app.sendAllNoteOff(true)
+	app.MidiSplitZones = zones
+}
+
+// findOverlappingSplitZone returns the index of a zone in zones sharing a key
+// with zone, or -1.
+func findOverlappingSplitZone(zones []splitZone, zone splitZone) int {
+	for i, other := range zones {
+		if zone.Low <= other.High && other.Low <= zone.High {
+			return i
+		}
+	}
+	return -1
+}
+
+// findSplitZone returns the index of the zone plus one, or 0 if the key is
+// not in any zone.
+func (app *application) findSplitZone(key uint8) (int, splitZone) {
+	for i, zone := range app.MidiSplitZones {
+		if key >= zone.Low && key <= zone.High {
+			return i + 1, zone
+		}
+	}
+	return 0, splitZone{}
+}
+
+// setMidiChannelRoute changes the route of channel (0-based).
+func (app *application) setMidiChannelRoute(channel int, route midiChannelRoute) {
+	app.sendAllNoteOff(true)
+	app.MidiChannelRouting[channel] = route
+}
+
+// deliverMidiInEvent is called by the MIDI driver, possibly from another
+// goroutine.
+func (app *application) deliverMidiInEvent(event []byte) {
+	_ = app.MidiRealtimeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+		app.onMidiInEvent(event)
+		return nil, nil
+	})
+}
+
 func (app *application) onMidiInEvent(event []byte) {
 	if len(event) == 0 {
 		return
 	}
+	if app.RemoteControlDevice == "input" && app.runRemoteControl(event) {
+		return
+	}
+	if app.MidiInMuted {
+		return
+	}
 	app.addMidiEvent(&midiQueueEvent{
-		Time:     time.Now(),
-		Message:  event,
-		Realtime: true,
+		Time:       app.clock.Now(),
+		Message:    event,
+		Realtime:   true,
+		Generation: atomic.LoadUint32(&app.midiGeneration),
 	})
 }
 
+// addMidiEvent takes an event stamped with the generation it was read in, so
+// one read by MidiPlaybackGoro before an emergency stop is not played after.
 func (app *application) addMidiEvent(event *midiQueueEvent) {
-	channel := event.Message[0] & 0xf
-	// Ignore percussion channel
-	if channel == 9 {
+	if app.isStaleMidiEvent(event) {
 		return
 	}
+	route := midiChannelRoute{Mode: "on"}
+	if event.Message[0] < 0xf0 {
+		route = app.MidiChannelRouting[event.Message[0]&0xf]
+	}
 	// Force channel 1
 	filteredMessage := make([]byte, len(event.Message))
 	copy(filteredMessage, event.Message)
 	filteredMessage[0] &= 0xf0
+	// All notes off always passes, so that no key is left pressed
+	if route.Mode == "off" && !(filteredMessage[0] == 0xb0 && len(filteredMessage) > 1 && filteredMessage[1] == 0x7b) {
+		return
+	}
+
+	// Split zones only apply to the keyboard
+	zoneIndex, zone := 0, splitZone{}
+	if event.Realtime && filteredMessage[0] >= 0x80 && filteredMessage[0] <= 0xa0 {
+		zoneIndex, zone = app.findSplitZone(filteredMessage[1])
+	}
+	route.Transpose += zone.Transpose
+	bend := app.pitchBendStatus(event)
 
 	expiry := event.Expiry
+	muted := false
+	noteOverflow := 0
 	switch filteredMessage[0] {
 	// Note off
 	case 0x80:
-		note := int(filteredMessage[1])
+		note := int(filteredMessage[1]) + route.Transpose
+		if bend != nil {
+			note += bend.noteOff(filteredMessage[1])
+		}
 		if !event.AlreadyTransposed {
 			note += app.MidiOutTranspose
-			if note < 0x00 || note > 0x7f {
-				return
-			}
-			filteredMessage[1] = uint8(note)
 		}
+		filteredMessage[1], noteOverflow = clampMidiNote(note)
+		muted = route.Mode == "mute"
 	// Note on
 	case 0x90:
 		if event.FastForward {
 			return
 		}
-		note := int(filteredMessage[1])
+		note := int(filteredMessage[1]) + route.Transpose
+		if app.captureMidiLearn(event, note) {
+			return
+		}
+		if bend != nil {
+			if filteredMessage[2] == 0 || filteredMessage[2] < app.MinTriggerVelocity {
+				note += bend.noteOff(filteredMessage[1])
+			} else {
+				note += bend.noteOn(filteredMessage[1], filteredMessage[2])
+			}
+		}
 		if !event.AlreadyTransposed {
 			note += app.MidiOutTranspose
-			if note < 0x00 || note > 0x7f {
-				return
-			}
-			filteredMessage[1] = uint8(note)
 		}
+		filteredMessage[1], noteOverflow = clampMidiNote(note)
+		muted = route.Mode == "mute"
 		if filteredMessage[2] == 0 || filteredMessage[2] < app.MinTriggerVelocity {
 			filteredMessage[0] = 0x80
 		} else {
@@ -266,14 +326,15 @@ func (app *application) addMidiEvent(event *midiQueueEvent) {
 		if event.FastForward {
 			return
 		}
-		note := int(filteredMessage[1])
+		note := int(filteredMessage[1]) + route.Transpose
+		if bend != nil {
+			note += bend.noteOffset(filteredMessage[1])
+		}
 		if !event.AlreadyTransposed {
 			note += app.MidiOutTranspose
-			if note < 0x00 || note > 0x7f {
-				return
-			}
-			filteredMessage[1] = uint8(note)
 		}
+		filteredMessage[1], noteOverflow = clampMidiNote(note)
+		muted = route.Mode == "mute"
 		if filteredMessage[2] == 0 {
 			filteredMessage[0] = 0x80
 		} else {
@@ -291,6 +352,9 @@ func (app *application) addMidiEvent(event *midiQueueEvent) {
 		if filteredMessage[1] == 0x00 || filteredMessage[1] == 0x20 {
 			return
 		}
+		if bend != nil && len(filteredMessage) > 2 {
+			bend.controlChange(filteredMessage[1], filteredMessage[2])
+		}
 	// Program change
 	case 0xc0:
 		return
@@ -299,80 +363,100 @@ func (app *application) addMidiEvent(event *midiQueueEvent) {
 		filteredMessage = filteredMessage[:2]
 	// Pitch bend
 	case 0xe0:
+		if bend != nil && len(filteredMessage) > 2 {
+			app.applyPitchBend(event, bend)
+		}
 		return
 	// System Messages
 	case 0xf0:
 	}
-	app.keystrokeQueue.AddActionWithExpiry(&midiQueueEvent{
+	// Late notes are dropped by produceKeystroke, depending on LateNotePolicy
+	app.keystrokeQueue.AddAction(&midiQueueEvent{
 		Time:              event.Time,
 		Expiry:            expiry,
 		Message:           filteredMessage,
 		Realtime:          event.Realtime,
 		FastForward:       event.FastForward,
 		AlreadyTransposed: true,
-	}, event.Time, expiry)
+		Transpose:         app.MidiOutTranspose,
+		OutOfRangePolicy:  event.OutOfRangePolicy,
+		Muted:             muted,
+		Zone:              zoneIndex,
+		ChordPolicy:       zone.ChordPolicy,
+		NoteOverflow:      noteOverflow,
+		Generation:        event.Generation,
+	}, event.Time)
+}
+
+// clampMidiNote returns the nearest MIDI note number, and how far the note
+// is beyond it.
+func clampMidiNote(note int) (uint8, int) {
+	switch {
+	case note < 0x00:
+		return 0x00, note
+	case note > 0x7f:
+		return 0x7f, note - 0x7f
+	}
+	return uint8(note), 0
 }
 
 func (app *application) sendMidiOutMessage(event *midiQueueEvent) error {
-	if app.MidiOutDevice == -1 {
+	// There is no such note on the synthesizer
+	if app.midiOutPort == nil || event.NoteOverflow != 0 {
 		return nil
 	}
-	var err error
-	switch len(event.Message) {
-	case 1:
-		err = winmm.MidiOutShortMsg(app.hMidiOut, uint32(event.Message[0]))
-	case 2:
-		err = winmm.MidiOutShortMsg(app.hMidiOut, uint32(event.Message[0])|(uint32(event.Message[1])<<8))
-	case 3:
-		err = winmm.MidiOutShortMsg(app.hMidiOut, uint32(event.Message[0])|(uint32(event.Message[1])<<8)|(uint32(event.Message[2])<<16))
-	default:
-		buffer := make([]byte, len(event.Message))
-		midiHeader := &winmm.MIDIHDR{
-			LpData:          &buffer[0],
-			DwBufferLength:  uint32(len(event.Message)),
-			DwBytesRecorded: uint32(len(event.Message)),
-		}
-		copy(buffer, event.Message)
-		err = winmm.MidiOutPrepareHeader(app.hMidiOut, midiHeader)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			for {
-				err := winmm.MidiOutUnprepareHeader(app.hMidiOut, midiHeader)
-				if err == nil {
-					break
-				}
-				if midiOutError, ok := err.(winmm.MidiOutError); !ok || uint32(midiOutError) != winmm.MIDIERR_STILLPLAYING {
-					break
-				}
-				runtime.Gosched()
-			}
-		}()
-		err = winmm.MidiOutLongMsg(app.hMidiOut, midiHeader)
-	}
-	return err
+	return app.midiOutPort.Send(event.Message)
 }
 
 func (app *application) sendAllNoteOff(realtime bool) {
+	if app.midiPitchBend != nil {
+		app.resetPitchBend(realtime)
+	}
 	app.addMidiEvent(&midiQueueEvent{
-		Message:  []byte{0xb0, 0x7b, 0x00},
-		Realtime: realtime,
+		Message:    []byte{0xb0, 0x7b, 0x00},
+		Realtime:   realtime,
+		Generation: atomic.LoadUint32(&app.midiGeneration),
 	})
 }
 
-func getMidiInDevName(uDeviceID uintptr) (string, error) {
-	lpMidiInCaps, err := winmm.MidiInGetDevCaps(uDeviceID)
+// emergencyStop stops the playback, discards the queued events, releases
+// every key and modifier, and silences MIDI output. With EmergencyStopMute,
+// MIDI input is ignored until it is re-armed.
+// It runs on MidiRealtimeGoro.
+func (app *application) emergencyStop() {
+	// Events already in keystrokeQueue and midiOutQueue are skipped
+	atomic.AddUint32(&app.midiGeneration, 1)
+	// MidiPlaybackGoro may be blocked submitting to us, don't wait for it
+	go app.cmdStopMidiPlayback()
+	if app.midiPitchBend != nil {
+		app.resetPitchBend(true)
+		app.resetPitchBend(false)
+	}
+	err := app.sendMidiOutMessage(&midiQueueEvent{
+		Message: []byte{0xb0, 0x7b, 0x00},
+	})
 	if err != nil {
-		return fmt.Sprintf("(Error: %s)", err.Error()), err
+		log.Println("Error: ", err)
 	}
-	return windows.UTF16ToString(lpMidiInCaps.SzPname[:]), nil
+	if app.EmergencyStopMute == "on" {
+		log.Println("MIDI input muted, re-arm it on the web console.")
+		app.MidiInMuted = true
+	}
+	_ = app.KeystrokeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+		app.releaseAllKeys(app.clock.Now())
+		return nil, nil
+	})
 }
 
-func getMidiOutDevName(uDeviceID uintptr) (string, error) {
-	lpMidiOutCaps, err := winmm.MidiOutGetDevCaps(uDeviceID)
-	if err != nil {
-		return fmt.Sprintf("(Error: %s)", err.Error()), err
+func (app *application) rearmMidiIn() {
+	if app.MidiInMuted {
+		log.Println("MIDI input re-armed.")
 	}
-	return windows.UTF16ToString(lpMidiOutCaps.SzPname[:]), nil
+	app.MidiInMuted = false
+}
+
+// isStaleMidiEvent tells if the event was read or queued before the last
+// emergency stop.
+func (app *application) isStaleMidiEvent(event *midiQueueEvent) bool {
+	return event.Generation != atomic.LoadUint32(&app.midiGeneration)
 }
@@ -0,0 +1,113 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	cgc "github.com/m13253/cgc-go"
+)
+
+// recordingMidiOutPort keeps the messages sent to MIDI output.
+type recordingMidiOutPort struct {
+	messages []string
+}
+
+func (p *recordingMidiOutPort) Send(message []byte) error {
+	p.messages = append(p.messages, fmt.Sprintf("% x", message))
+	return nil
+}
+
+func (p *recordingMidiOutPort) Close() error {
+	return nil
+}
+
+func TestMidiChannelRouting(t *testing.T) {
+	p := defaultPreset
+	p.MidiChannel[1] = midiChannelRoute{Mode: "off"}
+	p.MidiChannel[2] = midiChannelRoute{Mode: "mute"}
+	p.MidiChannel[3] = midiChannelRoute{Mode: "on", Transpose: 12}
+	for _, test := range []struct {
+		name     string
+		messages [][]byte
+		keys     []string
+		midiOut  []string
+	}{
+		{"on", [][]byte{{0x90, 0x3c, 0x40}, {0x80, 0x3c, 0x00}}, []string{"+'Q'", "-'Q'"}, []string{"90 3c 40", "80 3c 00"}},
+		{"off", [][]byte{{0x91, 0x3c, 0x40}, {0x81, 0x3c, 0x00}}, []string{}, []string{}},
+		{"mute", [][]byte{{0x92, 0x3c, 0x40}, {0x82, 0x3c, 0x00}}, []string{}, []string{"90 3c 40", "80 3c 00"}},
+		{"transpose", [][]byte{{0x93, 0x3c, 0x40}, {0x83, 0x3c, 0x00}}, []string{"+Shift", "+'Q'", "-'Q'"}, []string{"90 48 40", "80 48 00"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSimulation(t, p)
+			midiOut := &recordingMidiOutPort{messages: []string{}}
+			s.app.midiOutPort = midiOut
+			for _, message := range test.messages {
+				s.send(message...)
+				s.run(100 * time.Millisecond)
+			}
+			s.expectKeys(t, test.keys...)
+			if !reflect.DeepEqual(midiOut.messages, test.midiOut) {
+				t.Errorf("got MIDI output %q, want %q", midiOut.messages, test.midiOut)
+			}
+		})
+	}
+}
+
+func TestEmergencyStopDuringPlayback(t *testing.T) {
+	// Chord policies other than latest keep track of the notes in the queue
+	for _, policy := range []string{"latest", "arpeggio-up"} {
+		t.Run(policy, func(t *testing.T) {
+			p := defaultPreset
+			p.ChordPolicy = policy
+			s := newSimulation(t, p)
+			s.app.MidiPlaybackTracks = []uint16{0}
+			s.app.midiFileBuffer.sequence = decodeTestMidiFile(t, 0, []testMidiEvent{
+				{0, []byte{0x90, 0x3c, 0x40}},
+				{480, []byte{0x80, 0x3c, 0x00}},
+			})
+			start := s.clock.Now().Add(time.Second)
+			s.app.setMidiPlaybackScheduler(true, start, false, 0)
+			cgc.RunOneRequest(s.app.ctx, <-s.app.MidiRealtimeGoro)
+			s.app.playNextMidiEvent(s.clock.Now())
+			s.clock.AdvanceTo(start.Add(-s.app.ModifierCooldown))
+
+			// C4 is read before the emergency stop, but reaches addMidiEvent after it
+			s.app.playNextMidiEvent(s.clock.Now())
+			s.app.emergencyStop()
+			s.run(time.Second)
+			s.expectKeys(t)
+
+			// Playing goes on, and no key is stuck
+			s.send(0x90, 0x3c, 0x40)
+			s.run(100 * time.Millisecond)
+			s.send(0x80, 0x3c, 0x00)
+			s.run(100 * time.Millisecond)
+			s.expectKeys(t, "+'Q'", "-'Q'")
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/m13253/midimark"
+)
+
+var autoTransposeModes = []string{"off", "octave", "semitone"}
+
+// transposeCandidate tells how well the selected tracks can be played with
+// that transpose. A modifier switch is counted whenever a note needs other
+// modifiers, or in octave mode another octave, than the note before.
+type transposeCandidate struct {
+	Transpose        int `json:"transpose"`
+	Playable         int `json:"playable"`
+	OutOfRange       int `json:"out_of_range"`
+	ModifierSwitches int `json:"modifier_switches"`
+}
+
+// rankMidiTransposes ranks the transposes from -36 to +36 by playable notes,
+// then by modifier switches, then by distance from 0. Only octaves are
+// tried, unless semitones is set.
+//
+// Like in playback, a note is played on the key of the note minus the
+// transpose, plus the transpose of its channel in routing.
+func (app *application) rankMidiTransposes(events []midiPlaybackEvent, keybindings *[128]keybindingPreset, routing *[16]midiChannelRoute, semitones bool) []transposeCandidate {
+	step := 12
+	if semitones {
+		step = 1
+	}
+	candidates := []transposeCandidate{}
+	for transpose := -36; transpose <= 36; transpose += step {
+		candidate := transposeCandidate{
+			Transpose: transpose,
+		}
+		lastModifiers := -1
+		for _, event := range events {
+			noteOn, ok := event.Event.(*midimark.EventNoteOn)
+			if !ok || noteOn.Velocity == 0 || noteOn.Velocity < app.MinTriggerVelocity {
+				continue
+			}
+			note := int(noteOn.Key) + routing[noteOn.Status()&0x0f].Transpose - transpose
+			if note < 0x00 || note > 0x7f || keybindings[note].VirtualKeyCode == 0 {
+				candidate.OutOfRange++
+				continue
+			}
+			candidate.Playable++
+			modifiers := (int(app.octaveShift[note]) + 1) << 3
+			if keybindings[note].Ctrl {
+				modifiers |= 1
+			}
+			if keybindings[note].Alt {
+				modifiers |= 2
+			}
+			if keybindings[note].Shift {
+				modifiers |= 4
+			}
+			if lastModifiers >= 0 && modifiers != lastModifiers {
+				candidate.ModifierSwitches++
+			}
+			lastModifiers = modifiers
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := &candidates[i], &candidates[j]
+		if a.Playable != b.Playable {
+			return a.Playable > b.Playable
+		}
+		if a.ModifierSwitches != b.ModifierSwitches {
+			return a.ModifierSwitches < b.ModifierSwitches
+		}
+		return abs(a.Transpose) < abs(b.Transpose)
+	})
+	return candidates
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// suggestMidiTranspose ranks the transposes for the selected tracks of the
+// loaded MIDI file, with the keybindings in use. It waits for several
+// executors, so it must not be called from any of them.
+func (app *application) suggestMidiTranspose(semitones bool) ([]transposeCandidate, error) {
+	playbackSnapshot, err := app.snapshotMidiPlayback()
+	if err != nil {
+		return nil, err
+	}
+	realtimeSnapshot, err := app.snapshotMidiRealtime()
+	if err != nil {
+		return nil, err
+	}
+	keybindings, err := app.snapshotKeybindings()
+	if err != nil {
+		return nil, err
+	}
+	events, err := mergeMidiTracks(playbackSnapshot.Sequence, playbackSnapshot.Tracks, playbackSnapshot.Channels)
+	if err != nil {
+		return nil, err
+	}
+	return app.rankMidiTransposes(events, &keybindings, &realtimeSnapshot.ChannelRouting, semitones), nil
+}
+
+// requestAutoTranspose is called on MidiPlaybackGoro after the track
+// selection has changed.
+func (app *application) requestAutoTranspose() {
+	if app.AutoTranspose != "off" {
+		// suggestMidiTranspose waits for MidiPlaybackGoro
+		go app.autoTranspose()
+	}
+}
+
+// autoTranspose applies the best transpose for the selected tracks.
+func (app *application) autoTranspose() {
+	candidates, err := app.suggestMidiTranspose(app.AutoTranspose == "semitone")
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	best := candidates[0]
+	log.Printf("Transpose set to %+d automatically, %d of %d notes playable, %d modifier switches.\n", best.Transpose, best.Playable, best.Playable+best.OutOfRange, best.ModifierSwitches)
+	err = app.cmdSetMidiOutTranspose(best.Transpose)
+	if err != nil {
+		log.Println("Error: ", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m13253/midimark"
+)
+
+// TestDemoTransposeSuggestion checks that the transposes in demo/README.txt
+// are ranked first, or tie with the first one.
+func TestDemoTransposeSuggestion(t *testing.T) {
+	app := &application{
+		preset: defaultPreset,
+	}
+	for _, part := range readDemoParts(t) {
+		part := part
+		name := fmt.Sprintf("%s.part%d", strings.TrimSuffix(part.File, ".mid"), part.Track)
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("demo", part.File))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sequence, err := midimark.DecodeSequenceFromSMF(f, nil)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, err := mergeMidiTracks(sequence, []uint16{part.Track}, allMidiChannels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates := app.rankMidiTransposes(events, &app.Keybinding, &app.MidiChannel, false)
+			best := candidates[0]
+			for _, candidate := range candidates {
+				if candidate.Transpose != part.Transpose {
+					continue
+				}
+				if candidate.Playable != best.Playable || candidate.ModifierSwitches != best.ModifierSwitches {
+					t.Errorf("transpose %+d: got %+v, best %+v", part.Transpose, candidate, best)
+				}
+				return
+			}
+			t.Errorf("transpose %+d not ranked", part.Transpose)
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// +build windows
+
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/m13253/midi2ffxiv/winmm"
+	"golang.org/x/sys/windows"
+)
+
+// winmmMidiDriver talks to the Windows multimedia API. MIDI input arrives as
+// window messages, which must be forwarded to handleWindowMessage.
+type winmmMidiDriver struct {
+	hWnd   uintptr
+	mutex  sync.Mutex
+	inputs map[uintptr]*winmmMidiInPort
+}
+
+type winmmMidiInPort struct {
+	driver      *winmmMidiDriver
+	hMidiIn     uintptr
+	handler     midiInHandler
+	sysexBuffer [2]*winmm.MIDIHDR
+}
+
+type winmmMidiOutPort struct {
+	hMidiOut uintptr
+}
+
+func newWinmmMidiDriver(hWnd uintptr) *winmmMidiDriver {
+	return &winmmMidiDriver{
+		hWnd:   hWnd,
+		inputs: make(map[uintptr]*winmmMidiInPort),
+	}
+}
+
+func (d *winmmMidiDriver) ListInputs() []string {
+	midiInDeviceCount := winmm.MidiInGetNumDevs()
+	results := make([]string, midiInDeviceCount)
+	for i := uint32(0); i < midiInDeviceCount; i++ {
+		deviceName, _ := getMidiInDevName(uintptr(i))
+		results[i] = deviceName
+	}
+	return results
+}
+
+func (d *winmmMidiDriver) ListOutputs() []string {
+	midiOutDeviceCount := winmm.MidiOutGetNumDevs()
+	results := make([]string, midiOutDeviceCount)
+	for i := uint32(0); i < midiOutDeviceCount; i++ {
+		deviceName, _ := getMidiOutDevName(uintptr(i))
+		results[i] = deviceName
+	}
+	return results
+}
+
+func (d *winmmMidiDriver) OpenInput(index int, handler midiInHandler) (midiInPort, error) {
+	midiInDeviceCount := winmm.MidiInGetNumDevs()
+	if index < 0 || index >= int(midiInDeviceCount) {
+		return nil, winmm.MidiInError(winmm.MMSYSERR_BADDEVICEID)
+	}
+
+	hMidiIn, err := winmm.MidiInOpen(uint32(index), d.hWnd, 0, winmm.CALLBACK_WINDOW|winmm.MIDI_IO_STATUS)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &winmmMidiInPort{
+		driver:  d,
+		hMidiIn: hMidiIn,
+		handler: handler,
+	}
+	for i := range p.sysexBuffer {
+		p.sysexBuffer[i] = &winmm.MIDIHDR{
+			LpData:         &new([65536]byte)[0],
+			DwBufferLength: 65536,
+		}
+		err = winmm.MidiInPrepareHeader(hMidiIn, p.sysexBuffer[i])
+		if err != nil {
+			_ = winmm.MidiInClose(hMidiIn)
+			return nil, err
+		}
+		err = winmm.MidiInAddBuffer(hMidiIn, p.sysexBuffer[i])
+		if err != nil {
+			_ = winmm.MidiInClose(hMidiIn)
+			return nil, err
+		}
+	}
+
+	d.mutex.Lock()
+	d.inputs[hMidiIn] = p
+	d.mutex.Unlock()
+
+	err = winmm.MidiInStart(hMidiIn)
+	if err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (d *winmmMidiDriver) OpenOutput(index int) (midiOutPort, error) {
+	midiOutDeviceCount := winmm.MidiOutGetNumDevs()
+	if index < 0 || index >= int(midiOutDeviceCount) {
+		return nil, winmm.MidiOutError(winmm.MMSYSERR_BADDEVICEID)
+	}
+
+	hMidiOut, err := winmm.MidiOutOpen(uint32(index), d.hWnd, 0, winmm.CALLBACK_NULL)
+	if err != nil {
+		return nil, err
+	}
+	return &winmmMidiOutPort{hMidiOut}, nil
+}
+
+// handleWindowMessage processes MM_MIM_* messages, it returns false if the
+// message is not related to MIDI input.
+func (d *winmmMidiDriver) handleWindowMessage(uMsg uint32, wParam, lParam uintptr) bool {
+	switch uMsg {
+	case winmm.MM_MIM_OPEN:
+		// no-op
+	case winmm.MM_MIM_CLOSE:
+		// no-op
+	case winmm.MM_MIM_DATA, winmm.MM_MIM_MOREDATA:
+		midiEvent := []byte{byte(lParam), byte(lParam >> 8), byte(lParam >> 16)}
+		if p := d.lookupInput(wParam); p != nil {
+			p.handler(midiEvent)
+		}
+	case winmm.MM_MIM_LONGDATA:
+		midiHeader := *(**winmm.MIDIHDR)(unsafe.Pointer(&lParam))
+		midiEvent := make([]byte, midiHeader.DwBytesRecorded)
+		copy(midiEvent, (*[65536]byte)(unsafe.Pointer(midiHeader.LpData))[:midiHeader.DwBytesRecorded])
+		if p := d.lookupInput(wParam); p != nil {
+			if len(midiEvent) != 0 {
+				p.handler(midiEvent)
+			}
+			err := winmm.MidiInAddBuffer(p.hMidiIn, midiHeader)
+			if err != nil {
+				log.Println("Error: ", err)
+			}
+		}
+	case winmm.MM_MIM_ERROR:
+		midiEvent := []byte{byte(lParam), byte(lParam >> 8), byte(lParam >> 16)}
+		log.Printf("Invalid MIDI message: %x\n", midiEvent)
+	case winmm.MM_MIM_LONGERROR:
+		midiHeader := *(**winmm.MIDIHDR)(unsafe.Pointer(&lParam))
+		midiEvent := make([]byte, midiHeader.DwBytesRecorded)
+		copy(midiEvent, (*[65536]byte)(unsafe.Pointer(midiHeader.LpData))[:midiHeader.DwBytesRecorded])
+		log.Printf("Invalid MIDI message: %x\n", midiEvent)
+		if p := d.lookupInput(wParam); p != nil {
+			err := winmm.MidiInAddBuffer(p.hMidiIn, midiHeader)
+			if err != nil {
+				log.Println("Error: ", err)
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (d *winmmMidiDriver) lookupInput(hMidiIn uintptr) *winmmMidiInPort {
+	d.mutex.Lock()
+	p := d.inputs[hMidiIn]
+	d.mutex.Unlock()
+	return p
+}
+
+func (p *winmmMidiInPort) Close() error {
+	p.driver.mutex.Lock()
+	delete(p.driver.inputs, p.hMidiIn)
+	p.driver.mutex.Unlock()
+	for i := range p.sysexBuffer {
+		_ = winmm.MidiInUnprepareHeader(p.hMidiIn, p.sysexBuffer[i])
+	}
+	return winmm.MidiInClose(p.hMidiIn)
+}
+
+func (p *winmmMidiOutPort) Send(message []byte) error {
+	var err error
+	switch len(message) {
+	case 0:
+	case 1:
+		err = winmm.MidiOutShortMsg(p.hMidiOut, uint32(message[0]))
+	case 2:
+		err = winmm.MidiOutShortMsg(p.hMidiOut, uint32(message[0])|(uint32(message[1])<<8))
+	case 3:
+		err = winmm.MidiOutShortMsg(p.hMidiOut, uint32(message[0])|(uint32(message[1])<<8)|(uint32(message[2])<<16))
+	default:
+		buffer := make([]byte, len(message))
+		midiHeader := &winmm.MIDIHDR{
+			LpData:          &buffer[0],
+			DwBufferLength:  uint32(len(message)),
+			DwBytesRecorded: uint32(len(message)),
+		}
+		copy(buffer, message)
+		err = winmm.MidiOutPrepareHeader(p.hMidiOut, midiHeader)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			for {
+				err := winmm.MidiOutUnprepareHeader(p.hMidiOut, midiHeader)
+				if err == nil {
+					break
+				}
+				if midiOutError, ok := err.(winmm.MidiOutError); !ok || uint32(midiOutError) != winmm.MIDIERR_STILLPLAYING {
+					break
+				}
+				runtime.Gosched()
+			}
+		}()
+		err = winmm.MidiOutLongMsg(p.hMidiOut, midiHeader)
+	}
+	return err
+}
+
+// Close waits for a second before closing the device, so that pending
+// messages (e.g. all notes off) have a chance to be played.
+func (p *winmmMidiOutPort) Close() error {
+	hMidiOut := p.hMidiOut
+	time.AfterFunc(1*time.Second, func() {
+		_ = winmm.MidiOutClose(hMidiOut)
+	})
+	return nil
+}
+
+func getMidiInDevName(uDeviceID uintptr) (string, error) {
+	lpMidiInCaps, err := winmm.MidiInGetDevCaps(uDeviceID)
+	if err != nil {
+		return fmt.Sprintf("(Error: %s)", err.Error()), err
+	}
+	return windows.UTF16ToString(lpMidiInCaps.SzPname[:]), nil
+}
+
+func getMidiOutDevName(uDeviceID uintptr) (string, error) {
+	lpMidiOutCaps, err := winmm.MidiOutGetDevCaps(uDeviceID)
+	if err != nil {
+		return fmt.Sprintf("(Error: %s)", err.Error()), err
+	}
+	return windows.UTF16ToString(lpMidiOutCaps.SzPname[:]), nil
+}
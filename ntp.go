@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -71,16 +69,8 @@ func (app *application) syncTime(ntpServer string) error {
 	app.NtpClockOffset = clockOffset / 4
 	app.NtpMaxDeviation = rootDistance
 	app.NtpLastSync = time.Now()
+	app.NtpSyncServer = ntpServer
 	app.ntpMutex.Unlock()
 	log.Println("Time synchronized.")
 	return nil
 }
-
-func (app *application) getNtpOffset() (bool, time.Duration, time.Duration) {
-	app.ntpMutex.RLock()
-	synced := !app.NtpLastSync.IsZero()
-	offset := app.NtpClockOffset
-	deviation := app.NtpMaxDeviation
-	app.ntpMutex.RUnlock()
-	return synced, offset, deviation
-}
@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -45,7 +43,58 @@ func (app *application) parseConfigFile() error {
 		return nil
 	}
 	defer f.Close()
-	buf := bufio.NewReader(f)
+	return app.parseConfig(f)
+}
+
+// reloadConfigFile reads the config file again and applies the options that
+// can also be changed on the web console. Other options need a restart.
+func (app *application) reloadConfigFile() error {
+	reloaded := &application{
+		preset: defaultPreset,
+	}
+	reloaded.ConfigFile = app.ConfigFile
+	f, err := os.Open(app.ConfigFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = reloaded.parseConfig(f)
+	if err != nil {
+		return err
+	}
+
+	realtime, err := app.snapshotMidiRealtime()
+	if err != nil {
+		return err
+	}
+	for channel, route := range reloaded.MidiChannel {
+		if route != realtime.ChannelRouting[channel] {
+			err = app.cmdSetMidiChannelRoute(channel, route)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = app.cmdSetMidiSplitZones(reloaded.SplitZone)
+	if err != nil {
+		return err
+	}
+
+	if reloaded.KeybindingMode != app.KeybindingMode || reloaded.OctaveCenter != app.OctaveCenter {
+		log.Println("KeybindingMode or OctaveCenter changed, keybindings will be reloaded after restart.")
+	} else {
+		err = app.cmdSetDefaultKeybindings(&reloaded.Keybinding)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Reloaded channel routing, split zones and keybindings from %s, other options take effect after restart.\n", app.ConfigFile)
+	return nil
+}
+
+func (app *application) parseConfig(r io.Reader) error {
+	var err error
+	buf := bufio.NewReader(r)
 	for {
 		line, lineerr := buf.ReadString('\n')
 		if strings.HasPrefix(line, "#") {
@@ -62,6 +111,8 @@ func (app *application) parseConfigFile() error {
 		switch fields[0] {
 		case "IdleDuration":
 			err = app.parseConfigDuration(fields, &app.IdleDuration)
+		case "MaxKeyHold":
+			err = app.parseConfigDuration(fields, &app.MaxKeyHold)
 		case "RealtimeExtraDelay":
 			err = app.parseConfigDuration(fields, &app.RealtimeExtraDelay)
 		case "PlaybackExtraDelay":
@@ -80,10 +131,48 @@ func (app *application) parseConfigFile() error {
 			err = app.parseConfigDuration(fields, &app.NtpCooldown)
 		case "MinTriggerVelocity":
 			err = app.parseConfigUint8(fields, &app.MinTriggerVelocity)
+		case "ChordPolicy":
+			err = app.parseConfigEnum(fields, &app.ChordPolicy, chordPolicies...)
+		case "ChordWindow":
+			err = app.parseConfigDuration(fields, &app.ChordWindow)
+		case "OutOfRangePolicy":
+			err = app.parseConfigEnum(fields, &app.OutOfRangePolicy, outOfRangePolicies...)
+		case "AutoTranspose":
+			err = app.parseConfigEnum(fields, &app.AutoTranspose, autoTransposeModes...)
+		case "LateNotePolicy":
+			err = app.parseConfigEnum(fields, &app.LateNotePolicy, lateNotePolicies...)
+		case "PitchBendPolicy":
+			err = app.parseConfigEnum(fields, &app.PitchBendPolicy, pitchBendPolicies...)
+		case "PitchBendThreshold":
+			err = app.parseConfigPitchBendThreshold(fields, &app.PitchBendThreshold)
+		case "MidiDriver":
+			err = app.parseConfigString(fields, &app.MidiDriver)
+		case "MidiChannel":
+			err = app.parseConfigMidiChannel(fields, &app.MidiChannel)
+		case "SplitZone":
+			err = app.parseConfigSplitZone(fields, &app.SplitZone)
+		case "KeybindingMode":
+			err = app.parseConfigEnum(fields, &app.KeybindingMode, "modifier", "octave")
 		case "Keybinding":
 			err = app.parseConfigKeybindings(fields, &app.Keybinding)
+		case "PitchKeybinding":
+			err = app.parseConfigPitchKeybinding(fields, &app.PitchKeybinding)
+		case "OctaveUp":
+			err = app.parseConfigKeybinding(fields, &app.OctaveUp)
+		case "OctaveDown":
+			err = app.parseConfigKeybinding(fields, &app.OctaveDown)
+		case "OctaveCenter":
+			err = app.parseConfigOctaveCenter(fields, &app.OctaveCenter)
+		case "KeybindingProfile":
+			err = app.parseConfigKeybindingProfile(fields, &app.KeybindingProfile)
+		case "RemoteControlDevice":
+			err = app.parseConfigDeviceName(fields, &app.RemoteControlDevice)
+		case "RemoteControl":
+			err = app.parseConfigRemoteControl(fields, &app.RemoteControl)
 		case "EmergencyStop":
 			err = app.parseConfigKeybinding(fields, &app.EmergencyStop)
+		case "EmergencyStopMute":
+			err = app.parseConfigEnum(fields, &app.EmergencyStopMute, "on", "off")
 		case "WebListenAddr":
 			err = app.parseConfigString(fields, &app.WebListenAddr)
 		case "WebUsername":
@@ -100,7 +189,11 @@ func (app *application) parseConfigFile() error {
 			break
 		}
 	}
-	return nil
+	err = app.applyKeybindingMode()
+	if err != nil {
+		return err
+	}
+	return app.checkRemoteControls()
 }
 
 func (app *application) parseConfigDuration(fields []string, dest *time.Duration) error {
@@ -139,6 +232,107 @@ func (app *application) parseConfigString(fields []string, dest *string) error {
 	return nil
 }
 
+func (app *application) parseConfigDeviceName(fields []string, dest *string) error {
+	if len(fields) < 2 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	// Device names may contain spaces
+	*dest = strings.Join(fields[1:], " ")
+	return nil
+}
+
+func (app *application) parseConfigEnum(fields []string, dest *string, values ...string) error {
+	if len(fields) != 2 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	for _, i := range values {
+		if strings.EqualFold(fields[1], i) {
+			*dest = i
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q for option %q, must be one of %s", fields[1], fields[0], strings.Join(values, ", "))
+}
+
+func (app *application) parseConfigPitchBendThreshold(fields []string, dest *int) error {
+	if len(fields) != 2 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	value, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return err
+	}
+	if value < 1 || value > 100 {
+		return fmt.Errorf("pitch bend threshold %d out of range, must be 1 to 100 cents", value)
+	}
+	*dest = int(value)
+	return nil
+}
+
+func (app *application) parseConfigMidiChannel(fields []string, dest *[16]midiChannelRoute) error {
+	if len(fields) != 3 && len(fields) != 4 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	channel, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return err
+	}
+	if channel < 1 || channel > 16 {
+		return fmt.Errorf("MIDI channel %d out of range", channel)
+	}
+	route := midiChannelRoute{}
+	err = app.parseConfigEnum([]string{fields[0], fields[2]}, &route.Mode, midiChannelModes...)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 4 {
+		transpose, err := strconv.ParseInt(fields[3], 0, 8)
+		if err != nil {
+			return err
+		}
+		route.Transpose = int(transpose)
+	}
+	dest[channel-1] = route
+	return nil
+}
+
+func (app *application) parseConfigSplitZone(fields []string, dest *[]splitZone) error {
+	if len(fields) != 4 && len(fields) != 5 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	zone := splitZone{}
+	var err error
+	zone.Low, err = noteNameToIndex(fields[1])
+	if err != nil {
+		return err
+	}
+	zone.High, err = noteNameToIndex(fields[2])
+	if err != nil {
+		return err
+	}
+	if zone.Low > zone.High {
+		return fmt.Errorf("split zone %s to %s is empty", fields[1], fields[2])
+	}
+	if i := findOverlappingSplitZone(*dest, zone); i >= 0 {
+		low, _ := noteIndexToName((*dest)[i].Low)
+		high, _ := noteIndexToName((*dest)[i].High)
+		return fmt.Errorf("split zone %s to %s overlaps %s to %s", fields[1], fields[2], low, high)
+	}
+	transpose, err := strconv.ParseInt(fields[3], 0, 8)
+	if err != nil {
+		return err
+	}
+	zone.Transpose = int(transpose)
+	if len(fields) == 5 {
+		err = app.parseConfigEnum([]string{fields[0], fields[4]}, &zone.ChordPolicy, chordPolicies...)
+		if err != nil {
+			return err
+		}
+	}
+	*dest = append(*dest, zone)
+	return nil
+}
+
 func (app *application) parseConfigKeybinding(fields []string, dest **keybindingPreset) error {
 	if len(fields) < 2 {
 		return fmt.Errorf("syntax error in option %q", fields[0])
@@ -203,6 +397,135 @@ func (app *application) parseConfigKeybindings(fields []string, dest *[128]keybi
 	return nil
 }
 
+func (app *application) parseConfigPitchKeybinding(fields []string, dest *[13]keybindingPreset) error {
+	if len(fields) < 3 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	pitchIndex, err := pitchNameToIndex(fields[1])
+	if err != nil {
+		return err
+	}
+	var keybind *keybindingPreset
+	err = app.parseConfigKeybinding(append([]string{fields[0]}, fields[2:]...), &keybind)
+	if err != nil {
+		return err
+	}
+	dest[pitchIndex] = *keybind
+	return nil
+}
+
+func (app *application) parseConfigKeybindingProfile(fields []string, dest *[]keybindingProfile) error {
+	if len(fields) != 3 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	f, err := os.Open(fields[2])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	profile := &application{preset: defaultPreset}
+	err = profile.parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fields[2], err)
+	}
+	if profile.KeybindingMode != "modifier" {
+		return fmt.Errorf("%s: keybinding profiles only support KeybindingMode modifier", fields[2])
+	}
+	*dest = append(*dest, keybindingProfile{
+		Name:       fields[1],
+		Keybinding: profile.Keybinding,
+	})
+	return nil
+}
+
+func (app *application) parseConfigRemoteControl(fields []string, dest *[]remoteControl) error {
+	if len(fields) != 4 && len(fields) != 5 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	control := remoteControl{}
+	err := app.parseConfigEnum([]string{fields[0], fields[1]}, &control.Message, "Note", "CC", "Program")
+	if err != nil {
+		return err
+	}
+	if control.Message == "Note" {
+		control.Number, err = noteNameToIndex(fields[2])
+	} else {
+		var number uint64
+		number, err = strconv.ParseUint(fields[2], 0, 7)
+		control.Number = uint8(number)
+	}
+	if err != nil {
+		return err
+	}
+	err = app.parseConfigEnum([]string{fields[0], fields[3]}, &control.Action, remoteControlActions...)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 5 {
+		control.Argument = fields[4]
+	}
+	*dest = append(*dest, control)
+	return nil
+}
+
+func (app *application) parseConfigOctaveCenter(fields []string, dest *uint8) error {
+	if len(fields) != 2 {
+		return fmt.Errorf("syntax error in option %q", fields[0])
+	}
+	noteIndex, err := noteNameToIndex(fields[1])
+	if err != nil {
+		return err
+	}
+	// The C above the highest octave must still be a MIDI note
+	if noteIndex%12 != 0 || noteIndex < 0x0c || noteIndex > 0x60 {
+		return fmt.Errorf("option %q must be a C between C0 and C7", fields[0])
+	}
+	*dest = noteIndex
+	return nil
+}
+
+// applyKeybindingMode fills Keybinding from PitchKeybinding in octave mode.
+// The playable range is the octave from OctaveCenter, one octave below and
+// one octave above. The key for "C+" plays the C above the highest octave.
+func (app *application) applyKeybindingMode() error {
+	if app.KeybindingMode != "octave" {
+		return nil
+	}
+	if app.OctaveUp == nil || app.OctaveDown == nil {
+		return fmt.Errorf("OctaveUp and OctaveDown are required in octave mode")
+	}
+	for _, i := range []*keybindingPreset{app.OctaveUp, app.OctaveDown} {
+		if i.Ctrl || i.Alt || i.Shift {
+			return fmt.Errorf("OctaveUp and OctaveDown must not have modifiers")
+		}
+	}
+	app.Keybinding = [128]keybindingPreset{}
+	app.octaveShift = [128]int8{}
+	for octave := -1; octave <= 1; octave++ {
+		for pitch := 0; pitch < 12; pitch++ {
+			note := int(app.OctaveCenter) + octave*12 + pitch
+			app.Keybinding[note] = app.PitchKeybinding[pitch]
+			app.octaveShift[note] = int8(octave)
+		}
+	}
+	highC := int(app.OctaveCenter) + 24
+	app.Keybinding[highC] = app.PitchKeybinding[12]
+	app.octaveShift[highC] = 1
+	return nil
+}
+
+// pitchNameToIndex accepts a note name without octave, or "C+" for the C one
+// octave above.
+func pitchNameToIndex(name string) (int, error) {
+	if name == "C+" {
+		return 12, nil
+	}
+	if index, ok := noteNameToIndexTable[name+"4"]; ok {
+		return int(index) - 0x3c, nil
+	}
+	return -1, fmt.Errorf("unrecognized pitch name %q", name)
+}
+
 var (
 	noteIndexToNameTable = [128]string{
 		"C-1", "C#-1", "D-1", "Eb-1", "E-1", "F-1", "F#-1", "G-1", "Ab-1", "A-1", "Bb-1", "B-1", "C0", "C#0", "D0", "Eb0", "E0", "F0", "F#0", "G0", "Ab0", "A0", "Bb0", "B0", "C1", "C#1", "D1", "Eb1", "E1", "F1", "F#1", "G1", "Ab1", "A1", "Bb1", "B1", "C2", "C#2", "D2", "Eb2", "E2", "F2", "F#2", "G2", "Ab2", "A2", "Bb2", "B2", "C3", "C#3", "D3", "Eb3", "E3", "F3", "F#3", "G3", "Ab3", "A3", "Bb3", "B3", "C4", "C#4", "D4", "Eb4", "E4", "F4", "F#4", "G4", "Ab4", "A4", "Bb4", "B4", "C5", "C#5", "D5", "Eb5", "E5", "F5", "F#5", "G5", "Ab5", "A5", "Bb5", "B5", "C6", "C#6", "D6", "Eb6", "E6", "F6", "F#6", "G6", "Ab6", "A6", "Bb6", "B6", "C7", "C#7", "D7", "Eb7", "E7", "F7", "F#7", "G7", "Ab7", "A7", "Bb7", "B7", "C8", "C#8", "D8", "Eb8", "E8", "F8", "F#8", "G8", "Ab8", "A8", "Bb8", "B8", "C9", "C#9", "D9", "Eb9", "E9", "F9", "F#9", "G9",
@@ -0,0 +1,127 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOctaveCenter(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		center uint8
+		ok     bool
+	}{
+		{"C0", 0x0c, true},
+		{"C7", 0x60, true},
+		{"C8", 0x6c, false},
+		{"C#4", 0x3d, false},
+	} {
+		app := &application{preset: defaultPreset}
+		err := app.parseConfigOctaveCenter([]string{"OctaveCenter", test.name}, &app.OctaveCenter)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("OctaveCenter %s: got no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("OctaveCenter %s: %v", test.name, err)
+			continue
+		}
+		if app.OctaveCenter != test.center {
+			t.Errorf("OctaveCenter %s: got %#02x, want %#02x", test.name, app.OctaveCenter, test.center)
+		}
+
+		app.KeybindingMode = "octave"
+		app.OctaveUp = &keybindingPreset{VirtualKeyCode: '9'}
+		app.OctaveDown = &keybindingPreset{VirtualKeyCode: '8'}
+		for i := range app.PitchKeybinding {
+			app.PitchKeybinding[i] = keybindingPreset{VirtualKeyCode: 'A' + uint8(i)}
+		}
+		err = app.applyKeybindingMode()
+		if err != nil {
+			t.Errorf("OctaveCenter %s: %v", test.name, err)
+			continue
+		}
+		for note, keybind := range app.Keybinding {
+			var want keybindingPreset
+			var wantShift int8
+			switch offset := note - int(test.center); {
+			case offset >= -12 && offset < 24:
+				want = app.PitchKeybinding[(offset+12)%12]
+				wantShift = int8((offset+12)/12 - 1)
+			case offset == 24:
+				want = app.PitchKeybinding[12]
+				wantShift = 1
+			}
+			if keybind != want || app.octaveShift[note] != wantShift {
+				t.Errorf("OctaveCenter %s: note %#02x got %+v shift %d, want %+v shift %d", test.name, note, keybind, app.octaveShift[note], want, wantShift)
+			}
+		}
+	}
+}
+
+func TestParseConfigSplitZone(t *testing.T) {
+	for _, test := range []struct {
+		lines []string
+		want  []splitZone
+		err   string
+	}{
+		{[]string{"SplitZone C-1 B3 12 lowest", "SplitZone C4 G9 0"}, []splitZone{{0x00, 0x3b, 12, "lowest"}, {0x3c, 0x7f, 0, ""}}, ""},
+		{[]string{"SplitZone C4 C4 -12 Arpeggio-Up"}, []splitZone{{0x3c, 0x3c, -12, "arpeggio-up"}}, ""},
+		{[]string{"SplitZone B3 C-1 12"}, nil, "split zone B3 to C-1 is empty"},
+		{[]string{"SplitZone C-1 C4 12", "SplitZone C4 G9 0"}, nil, "split zone C4 to G9 overlaps C-1 to C4"},
+		{[]string{"SplitZone C4 G9 0", "SplitZone C-1 G9 12"}, nil, "split zone C-1 to G9 overlaps C4 to G9"},
+		{[]string{"SplitZone C3 B3 0", "SplitZone C5 B5 0", "SplitZone E4 E5 0"}, nil, "split zone E4 to E5 overlaps C5 to B5"},
+		{[]string{"SplitZone C-1 B3"}, nil, `syntax error in option "SplitZone"`},
+		{[]string{"SplitZone C-1 B3 12 loudest"}, nil, "loudest"},
+		{[]string{"SplitZone C-1 B3 1000"}, nil, "out of range"},
+	} {
+		app := &application{preset: defaultPreset}
+		var zones []splitZone
+		var err error
+		for _, line := range test.lines {
+			err = app.parseConfigSplitZone(strings.Fields(line), &zones)
+			if err != nil {
+				break
+			}
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.lines, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.lines, err)
+			continue
+		}
+		if !reflect.DeepEqual(zones, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.lines, zones, test.want)
+		}
+	}
+}
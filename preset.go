@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -36,10 +34,45 @@ type keybindingPreset struct {
 	VirtualKeyCode uint8
 }
 
+// midiChannelRoute tells what to do with the messages on one MIDI channel.
+// Mode is "on", "off" (ignore the channel), or "mute" (send the notes to MIDI
+// output only, without pressing keys). Transpose is added to the notes.
+type midiChannelRoute struct {
+	Mode      string
+	Transpose int
+}
+
+// splitZone is a range of keys on the MIDI keyboard, from Low to High, with
+// its own Transpose. An empty ChordPolicy means the global one.
+type splitZone struct {
+	Low         uint8
+	High        uint8
+	Transpose   int
+	ChordPolicy string
+}
+
+// keybindingProfile is a set of keybindings loaded from another config file,
+// which can be switched to while playing.
+type keybindingProfile struct {
+	Name       string
+	Keybinding [128]keybindingPreset
+}
+
+// remoteControl maps a message from the remote-control device to an action.
+// Message is "Note", "CC" or "Program", and Number is the note, controller
+// or program number.
+type remoteControl struct {
+	Message  string
+	Number   uint8
+	Action   string
+	Argument string
+}
+
 type preset struct {
 	ConfigFile string
 
 	IdleDuration       time.Duration
+	MaxKeyHold         time.Duration
 	RealtimeExtraDelay time.Duration
 	PlaybackExtraDelay time.Duration
 	RealtimeMaxLatency time.Duration
@@ -49,8 +82,31 @@ type preset struct {
 	NtpSyncTimeout     time.Duration
 	NtpCooldown        time.Duration
 	MinTriggerVelocity uint8
+	ChordPolicy        string
+	ChordWindow        time.Duration
+	OutOfRangePolicy   string
+	AutoTranspose      string
+	LateNotePolicy     string
+	PitchBendPolicy    string
+	PitchBendThreshold int
+	MidiDriver         string
+	MidiChannel        [16]midiChannelRoute
+	SplitZone          []splitZone
+	KeybindingMode     string
 	Keybinding         [128]keybindingPreset
+	PitchKeybinding    [13]keybindingPreset
+	OctaveUp           *keybindingPreset
+	OctaveDown         *keybindingPreset
+	OctaveCenter       uint8
+	KeybindingProfile  []keybindingProfile
 	EmergencyStop      *keybindingPreset
+	EmergencyStopMute  string
+
+	RemoteControlDevice string
+	RemoteControl       []remoteControl
+
+	// In octave mode, the octave shift for each note in Keybinding
+	octaveShift [128]int8
 
 	WebListenAddr string
 	WebUsername   string
@@ -60,6 +116,7 @@ type preset struct {
 var defaultPreset = preset{
 	ConfigFile:         "midi2ffxiv.conf",
 	IdleDuration:       1000 * time.Millisecond,
+	MaxKeyHold:         10 * time.Second,
 	RealtimeExtraDelay: 0 * time.Millisecond,
 	PlaybackExtraDelay: 2000 * time.Millisecond,
 	RealtimeMaxLatency: 300 * time.Millisecond,
@@ -69,6 +126,23 @@ var defaultPreset = preset{
 	NtpSyncTimeout:     5 * time.Second,
 	NtpCooldown:        10 * time.Second,
 	MinTriggerVelocity: 16,
+	ChordPolicy:        "latest",
+	ChordWindow:        30 * time.Millisecond,
+	OutOfRangePolicy:   "drop",
+	AutoTranspose:      "off",
+	LateNotePolicy:     "drop",
+	PitchBendPolicy:    "ignore",
+	PitchBendThreshold: 50,
+	MidiDriver:         defaultMidiDriver,
+	KeybindingMode:     "modifier",
+	OctaveCenter:       0x3c,
+	MidiChannel: [16]midiChannelRoute{
+		{"on", 0}, {"on", 0}, {"on", 0}, {"on", 0},
+		{"on", 0}, {"on", 0}, {"on", 0}, {"on", 0},
+		// Ignore percussion channel
+		{"on", 0}, {"off", 0}, {"on", 0}, {"on", 0},
+		{"on", 0}, {"on", 0}, {"on", 0}, {"on", 0},
+	},
 	Keybinding: [128]keybindingPreset{
 		0x30: {true, false, false, 'Q'},
 		0x31: {true, false, false, '2'},
@@ -111,8 +185,9 @@ var defaultPreset = preset{
 
 		0x54: {false, false, true, 'I'},
 	},
-	EmergencyStop: &keybindingPreset{true, true, true, 0xdb},
-	WebListenAddr: ":65300",
-	WebUsername:   "",
-	WebPassword:   "",
+	EmergencyStop:     &keybindingPreset{true, true, true, 0xdb},
+	EmergencyStopMute: "off",
+	WebListenAddr:     ":65300",
+	WebUsername:       "",
+	WebPassword:       "",
 }
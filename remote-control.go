@@ -0,0 +1,224 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var remoteControlActions = []string{
+	"scheduler-start", "scheduler-stop", "scheduler-toggle", "emergency-stop",
+	"transpose", "transpose-up", "transpose-down",
+	"next-track", "previous-track", "keybinding-profile",
+}
+
+// checkRemoteControls validates the arguments of RemoteControl options, after
+// all the keybinding profiles are known.
+func (app *application) checkRemoteControls() error {
+	for _, control := range app.RemoteControl {
+		switch control.Action {
+		case "transpose":
+			if _, err := strconv.ParseInt(control.Argument, 0, 8); err != nil {
+				return fmt.Errorf("remote control %q needs a number of semitones", control.Action)
+			}
+		case "transpose-up", "transpose-down":
+			if _, err := strconv.ParseInt(control.Argument, 0, 8); control.Argument != "" && err != nil {
+				return fmt.Errorf("remote control %q needs a number of semitones", control.Action)
+			}
+		case "keybinding-profile":
+			if app.findKeybindingProfile(control.Argument) == nil {
+				return fmt.Errorf("unknown keybinding profile %q", control.Argument)
+			}
+		default:
+			if control.Argument != "" {
+				return fmt.Errorf("remote control %q takes no argument", control.Action)
+			}
+		}
+	}
+	return nil
+}
+
+// findKeybindingProfile returns the profile with that name. The keybindings
+// of the config file itself are called "default", the ones in use are kept in
+// keystrokeStatus.defaultKeybinding.
+func (app *application) findKeybindingProfile(name string) *keybindingProfile {
+	if name == "default" {
+		return &keybindingProfile{
+			Name:       name,
+			Keybinding: app.Keybinding,
+		}
+	}
+	for i := range app.KeybindingProfile {
+		if app.KeybindingProfile[i].Name == name {
+			return &app.KeybindingProfile[i]
+		}
+	}
+	return nil
+}
+
+func (app *application) initRemoteControl() {
+	if app.RemoteControlDevice == "" || app.RemoteControlDevice == "input" {
+		return
+	}
+	for i, name := range app.listMidiInDevices() {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(app.RemoteControlDevice)) {
+			err := app.openMidiControlDevice(i)
+			if err != nil {
+				log.Println("Error: ", err)
+			}
+			return
+		}
+	}
+	log.Printf("Remote control device %q not found.\n", app.RemoteControlDevice)
+}
+
+func (app *application) openMidiControlDevice(midiControlDevice int) error {
+	app.closeMidiControlDevice()
+	if midiControlDevice < 0 {
+		return nil
+	}
+
+	midiControlPort, err := app.midiDriver.OpenInput(midiControlDevice, app.deliverMidiControlEvent)
+	if err != nil {
+		return err
+	}
+
+	app.MidiControlDevice = midiControlDevice
+	app.midiControlPort = midiControlPort
+	return nil
+}
+
+func (app *application) closeMidiControlDevice() {
+	app.MidiControlDevice = -1
+	if app.midiControlPort == nil {
+		return
+	}
+	err := app.midiControlPort.Close()
+	if err != nil {
+		log.Println("Error: ", err)
+	}
+	app.midiControlPort = nil
+}
+
+// deliverMidiControlEvent is called by the MIDI driver, possibly from another
+// goroutine.
+func (app *application) deliverMidiControlEvent(event []byte) {
+	_ = app.MidiRealtimeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+		app.runRemoteControl(event)
+		return nil, nil
+	})
+}
+
+// runRemoteControl returns true if the message triggers an action.
+// Notes and controllers trigger on press (velocity or value from 64), but
+// are also taken on release, so they are never played.
+func (app *application) runRemoteControl(message []byte) bool {
+	if len(message) < 2 {
+		return false
+	}
+	kind, pressed := "", false
+	switch message[0] & 0xf0 {
+	case 0x80:
+		kind = "Note"
+	case 0x90:
+		kind, pressed = "Note", len(message) > 2 && message[2] != 0
+	case 0xb0:
+		kind, pressed = "CC", len(message) > 2 && message[2] >= 0x40
+	case 0xc0:
+		kind, pressed = "Program", true
+	default:
+		return false
+	}
+	for _, control := range app.RemoteControl {
+		if control.Message == kind && control.Number == message[1] {
+			if pressed {
+				app.runRemoteControlAction(&control)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// runRemoteControlAction runs on MidiRealtimeGoro. MidiPlaybackGoro may be
+// blocked submitting to us, so it is reached from another goroutine.
+func (app *application) runRemoteControlAction(control *remoteControl) {
+	log.Printf("Remote control: %s %s\n", control.Action, control.Argument)
+	switch control.Action {
+	case "scheduler-start":
+		startTime := app.clock.Now().Add(app.snapshotNtp().ClockOffset)
+		go app.MidiPlaybackGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+			app.setMidiPlaybackScheduler(true, startTime, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop)
+			return nil, nil
+		})
+	case "scheduler-stop":
+		go app.cmdStopMidiPlayback()
+	case "scheduler-toggle":
+		startTime := app.clock.Now().Add(app.snapshotNtp().ClockOffset)
+		go app.MidiPlaybackGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+			if app.MidiPlaybackScheduleEnabled {
+				app.setMidiPlaybackScheduler(false, app.MidiPlaybackSchedule, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop)
+			} else {
+				app.setMidiPlaybackScheduler(true, startTime, app.MidiPlaybackLoopEnabled, app.MidiPlaybackLoop)
+			}
+			return nil, nil
+		})
+	case "emergency-stop":
+		app.emergencyStop()
+	case "transpose":
+		transpose, _ := strconv.ParseInt(control.Argument, 0, 8)
+		app.setMidiOutTranspose(int(transpose))
+	case "transpose-up", "transpose-down":
+		transpose := int64(12)
+		if control.Argument != "" {
+			transpose, _ = strconv.ParseInt(control.Argument, 0, 8)
+		}
+		if control.Action == "transpose-down" {
+			transpose = -transpose
+		}
+		app.setMidiOutTranspose(app.MidiOutTranspose + int(transpose))
+	case "next-track", "previous-track":
+		delta := 1
+		if control.Action == "previous-track" {
+			delta = -1
+		}
+		go app.MidiPlaybackGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+			app.stepMidiPlaybackTracks(delta)
+			return nil, nil
+		})
+	case "keybinding-profile":
+		name := control.Argument
+		_ = app.KeystrokeGoro.SubmitNoWait(app.ctx, func(context.Context) (interface{}, error) {
+			err := app.setKeybindingProfile(name)
+			if err != nil {
+				log.Println("Error: ", err)
+			}
+			return nil, nil
+		})
+	}
+}
@@ -0,0 +1,62 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStepMidiPlaybackTracks(t *testing.T) {
+	track := []testMidiEvent{{0, []byte{0x90, 0x3c, 0x40}}, {480, []byte{0x80, 0x3c, 0x00}}}
+	sequence := decodeTestMidiFile(t, 1, nil, track, track, track)
+	for _, test := range []struct {
+		tracks []uint16
+		delta  int
+		want   []uint16
+	}{
+		{[]uint16{1}, 1, []uint16{2}},
+		{[]uint16{1}, -1, []uint16{0}},
+		// First and last track
+		{[]uint16{0}, -1, []uint16{0}},
+		{[]uint16{3}, 1, []uint16{3}},
+		{[]uint16{2}, 1, []uint16{3}},
+		// The whole selection moves, or none of it
+		{[]uint16{1, 2}, 1, []uint16{2, 3}},
+		{[]uint16{2, 3}, 1, []uint16{2, 3}},
+		{[]uint16{1, 3}, -1, []uint16{0, 2}},
+		{[]uint16{0, 2}, -1, []uint16{0, 2}},
+	} {
+		s := newSimulation(t, defaultPreset)
+		s.app.midiFileBuffer.sequence = sequence
+		s.app.MidiPlaybackTracks = test.tracks
+		s.app.stepMidiPlaybackTracks(test.delta)
+		s.run(time.Millisecond)
+		if !reflect.DeepEqual(s.app.MidiPlaybackTracks, test.want) {
+			t.Errorf("tracks %v %+d: got %v, want %v", test.tracks, test.delta, s.app.MidiPlaybackTracks, test.want)
+		}
+	}
+}
@@ -47,6 +47,7 @@ const (
 	VK_SHIFT              uint16  = 0x10
 	VK_CONTROL            uint16  = 0x11
 	VK_MENU               uint16  = 0x12
+	VK_ESCAPE             uint16  = 0x1b
 	MOD_ALT               uint16  = 0x0001
 	MOD_CONTROL           uint16  = 0x0002
 	MOD_NOREPEAT          uint16  = 0x4000
@@ -1,5 +1,3 @@
-// +build windows
-
 /*
    MIDI2FFXIV
    Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
@@ -26,7 +24,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -37,6 +34,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -56,7 +54,7 @@ type basicAuthHandler struct {
 	Password string
 }
 
-func (app *application) startWebServer() error {
+func (app *application) newWebHandlers() *webHandlers {
 	h := &webHandlers{
 		app:      app,
 		server:   new(http.Server),
@@ -70,16 +68,35 @@ func (app *application) startWebServer() error {
 	h.serveMux.Handle("/", http.FileServer(http.Dir("web")))
 	h.serveMux.HandleFunc("/version", h.version)
 	h.serveMux.HandleFunc("/midi-input-device", h.midiInputDevice)
+	h.serveMux.HandleFunc("/midi-control-device", h.midiControlDevice)
 	h.serveMux.HandleFunc("/midi-output-device", h.midiOutputDevice)
 	h.serveMux.HandleFunc("/midi-output-bank", h.midiOutputBank)
 	h.serveMux.HandleFunc("/midi-output-patch", h.midiOutputPatch)
 	h.serveMux.HandleFunc("/midi-output-transpose", h.midiOutputTranspose)
+	h.serveMux.HandleFunc("/midi-output-transpose-suggestion", h.midiOutputTransposeSuggestion)
+	h.serveMux.HandleFunc("/midi-channel-routing", h.midiChannelRouting)
+	h.serveMux.HandleFunc("/split-zones", h.splitZones)
+	h.serveMux.HandleFunc("/keybindings", h.keybindings)
+	h.serveMux.HandleFunc("/keybindings-save", h.keybindingsSave)
+	h.serveMux.HandleFunc("/keybinding-learn", h.keybindingLearn)
+	h.serveMux.HandleFunc("/keybinding-profile", h.keybindingProfile)
 	h.serveMux.HandleFunc("/current-time", h.currentTime)
 	h.serveMux.HandleFunc("/ntp-sync-server", h.ntpSyncServer)
 	h.serveMux.HandleFunc("/midi-playback-file", h.midiPlaybackFile)
 	h.serveMux.HandleFunc("/midi-playback-track", h.midiPlaybackTrack)
+	h.serveMux.HandleFunc("/midi-playback-channels", h.midiPlaybackChannels)
+	h.serveMux.HandleFunc("/midi-playback-analysis", h.midiPlaybackAnalysis)
 	h.serveMux.HandleFunc("/midi-playback-offset", h.midiPlaybackOffset)
+	h.serveMux.HandleFunc("/midi-playback-out-of-range-policy", h.midiPlaybackOutOfRangePolicy)
 	h.serveMux.HandleFunc("/scheduler", h.scheduler)
+	h.serveMux.HandleFunc("/dry-run", h.dryRun)
+	h.serveMux.HandleFunc("/statistics", h.statistics)
+	h.serveMux.HandleFunc("/emergency-stop", h.emergencyStop)
+	return h
+}
+
+func (app *application) startWebServer() error {
+	h := app.newWebHandlers()
 
 	originalAddr, err := net.ResolveTCPAddr("tcp", app.WebListenAddr)
 	availableAddr := new(net.TCPAddr)
@@ -171,9 +188,7 @@ func (h *webHandlers) midiInputDevice(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, err = h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			return nil, h.app.openMidiInDevice(int(value))
-		})
+		err = h.app.cmdOpenMidiInDevice(int(value))
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 503)
@@ -185,11 +200,41 @@ func (h *webHandlers) midiInputDevice(w http.ResponseWriter, r *http.Request) {
 		Devices  []string `json:"devices"`
 		Selected int      `json:"selected"`
 	}
-	h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Devices = h.app.listMidiInDevices()
-		result.Selected = h.app.MidiInDevice
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Devices = snapshot.MidiInDevices
+	result.Selected = snapshot.MidiInDevice
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) midiControlDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		value, err := strconv.ParseInt(string(body), 0, 32)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = h.app.cmdOpenMidiControlDevice(int(value))
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Devices  []string `json:"devices"`
+		Selected int      `json:"selected"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Devices = snapshot.MidiInDevices
+	result.Selected = snapshot.ControlDevice
 	writeJSON(w, result)
 }
 
@@ -207,9 +252,7 @@ func (h *webHandlers) midiOutputDevice(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, err = h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			return nil, h.app.openMidiOutDevice(int(value))
-		})
+		err = h.app.cmdOpenMidiOutDevice(int(value))
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 503)
@@ -221,11 +264,9 @@ func (h *webHandlers) midiOutputDevice(w http.ResponseWriter, r *http.Request) {
 		Devices  []string `json:"devices"`
 		Selected int      `json:"selected"`
 	}
-	h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Devices = h.app.listMidiOutDevices()
-		result.Selected = h.app.MidiOutDevice
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Devices = snapshot.MidiOutDevices
+	result.Selected = snapshot.MidiOutDevice
 	writeJSON(w, result)
 }
 
@@ -243,19 +284,14 @@ func (h *webHandlers) midiOutputBank(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, _ = h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			h.app.setMidiOutBank(uint16(value))
-			return nil, nil
-		})
+		_ = h.app.cmdSetMidiOutBank(uint16(value))
 	}
 
 	var result struct {
 		Bank uint16 `json:"bank"`
 	}
-	h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Bank = h.app.MidiOutBank
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Bank = snapshot.MidiOutBank
 	writeJSON(w, result)
 }
 
@@ -273,19 +309,14 @@ func (h *webHandlers) midiOutputPatch(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, _ = h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			h.app.setMidiOutPatch(uint8(value))
-			return nil, nil
-		})
+		_ = h.app.cmdSetMidiOutPatch(uint8(value))
 	}
 
 	var result struct {
 		Patch uint8 `json:"patch"`
 	}
-	h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Patch = h.app.MidiOutPatch
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Patch = snapshot.MidiOutPatch
 	writeJSON(w, result)
 }
 
@@ -303,10 +334,7 @@ func (h *webHandlers) midiOutputTranspose(w http.ResponseWriter, r *http.Request
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, err = h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			h.app.setMidiOutTranspose(int(value))
-			return nil, nil
-		})
+		err = h.app.cmdSetMidiOutTranspose(int(value))
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 503)
@@ -317,10 +345,373 @@ func (h *webHandlers) midiOutputTranspose(w http.ResponseWriter, r *http.Request
 	var result struct {
 		Transpose int `json:"transpose"`
 	}
-	h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Transpose = h.app.MidiOutTranspose
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Transpose = snapshot.MidiOutTranspose
+	writeJSON(w, result)
+}
+
+// midiOutputTransposeSuggestion ranks the transposes for the selected
+// tracks, POST also applies the best one.
+func (h *webHandlers) midiOutputTransposeSuggestion(w http.ResponseWriter, r *http.Request) {
+	semitones := h.app.AutoTranspose == "semitone"
+	if value := r.URL.Query().Get("semitones"); value != "" {
+		var err error
+		semitones, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	candidates, err := h.app.suggestMidiTranspose(semitones)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.Method == "POST" {
+		err = h.app.cmdSetMidiOutTranspose(candidates[0].Transpose)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Transpose  int                  `json:"transpose"`
+		Candidates []transposeCandidate `json:"candidates"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Transpose = snapshot.MidiOutTranspose
+	result.Candidates = candidates
+	writeJSON(w, result)
+}
+
+type webMidiChannelRoute struct {
+	Channel   int    `json:"channel"`
+	Mode      string `json:"mode"`
+	Transpose int    `json:"transpose"`
+}
+
+func (h *webHandlers) midiChannelRouting(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var route webMidiChannelRoute
+		err = json.Unmarshal(body, &route)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if route.Channel < 1 || route.Channel > 16 {
+			http.Error(w, fmt.Sprintf("MIDI channel %d out of range", route.Channel), 400)
+			return
+		}
+		route.Mode = strings.ToLower(route.Mode)
+		if !isMidiChannelMode(route.Mode) {
+			http.Error(w, fmt.Sprintf("invalid channel mode %q", route.Mode), 400)
+			return
+		}
+		if route.Transpose < -0x7f || route.Transpose > 0x7f {
+			http.Error(w, fmt.Sprintf("transpose %d out of range", route.Transpose), 400)
+			return
+		}
+		err = h.app.cmdSetMidiChannelRoute(route.Channel-1, midiChannelRoute{
+			Mode:      route.Mode,
+			Transpose: route.Transpose,
+		})
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Channels []webMidiChannelRoute `json:"channels"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Channels = make([]webMidiChannelRoute, len(snapshot.ChannelRouting))
+	for i, route := range snapshot.ChannelRouting {
+		result.Channels[i] = webMidiChannelRoute{
+			Channel:   i + 1,
+			Mode:      route.Mode,
+			Transpose: route.Transpose,
+		}
+	}
+	writeJSON(w, result)
+}
+
+type webSplitZone struct {
+	Low         uint8  `json:"low"`
+	High        uint8  `json:"high"`
+	Transpose   int    `json:"transpose"`
+	ChordPolicy string `json:"chord_policy"`
+}
+
+func (h *webHandlers) splitZones(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var request []webSplitZone
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		zones := make([]splitZone, len(request))
+		for i, zone := range request {
+			if zone.Low > zone.High || zone.High > 0x7f {
+				http.Error(w, fmt.Sprintf("invalid split zone %d to %d", zone.Low, zone.High), 400)
+				return
+			}
+			if zone.Transpose < -0x7f || zone.Transpose > 0x7f {
+				http.Error(w, fmt.Sprintf("transpose %d out of range", zone.Transpose), 400)
+				return
+			}
+			zone.ChordPolicy = strings.ToLower(zone.ChordPolicy)
+			if zone.ChordPolicy != "" && !isChordPolicy(zone.ChordPolicy) {
+				http.Error(w, fmt.Sprintf("invalid chord policy %q", zone.ChordPolicy), 400)
+				return
+			}
+			zones[i] = splitZone{
+				Low:         zone.Low,
+				High:        zone.High,
+				Transpose:   zone.Transpose,
+				ChordPolicy: zone.ChordPolicy,
+			}
+			if j := findOverlappingSplitZone(zones[:i], zones[i]); j >= 0 {
+				http.Error(w, fmt.Sprintf("split zone %d to %d overlaps %d to %d", zone.Low, zone.High, zones[j].Low, zones[j].High), 400)
+				return
+			}
+		}
+		err = h.app.cmdSetMidiSplitZones(zones)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Zones []webSplitZone `json:"zones"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Zones = make([]webSplitZone, len(snapshot.SplitZones))
+	for i, zone := range snapshot.SplitZones {
+		result.Zones[i] = webSplitZone{
+			Low:         zone.Low,
+			High:        zone.High,
+			Transpose:   zone.Transpose,
+			ChordPolicy: zone.ChordPolicy,
+		}
+	}
+	writeJSON(w, result)
+}
+
+type webKeybinding struct {
+	Note    uint8  `json:"note"`
+	Name    string `json:"name"`
+	Key     uint8  `json:"key"`
+	KeyName string `json:"key_name"`
+	Ctrl    bool   `json:"ctrl"`
+	Alt     bool   `json:"alt"`
+	Shift   bool   `json:"shift"`
+}
+
+func (h *webHandlers) keybindings(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == "PUT" || r.Method == "DELETE") && h.app.KeybindingMode != "modifier" {
+		http.Error(w, "keybindings can not be changed in octave mode, edit PitchKeybinding in the config file instead", 409)
+		return
+	}
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var request webKeybinding
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		noteIndex, err := noteNameToIndex(request.Name)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if request.Key == 0 || request.Key == vkControl || request.Key == vkMenu || request.Key == vkShift {
+			http.Error(w, fmt.Sprintf("invalid key 0x%02x", request.Key), 400)
+			return
+		}
+		err = h.app.cmdSetKeybinding(noteIndex, keybindingPreset{
+			Ctrl:           request.Ctrl,
+			Alt:            request.Alt,
+			Shift:          request.Shift,
+			VirtualKeyCode: request.Key,
+		})
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	} else if r.Method == "DELETE" {
+		noteIndex, err := noteNameToIndex(r.URL.Query().Get("note"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = h.app.cmdSetKeybinding(noteIndex, keybindingPreset{})
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	keybindings, err := h.app.snapshotKeybindings()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	var result struct {
+		Mode        string          `json:"mode"`
+		Keybindings []webKeybinding `json:"keybindings"`
+	}
+	result.Mode = h.app.KeybindingMode
+	result.Keybindings = []webKeybinding{}
+	for i, keybind := range keybindings {
+		if keybind.VirtualKeyCode == 0 {
+			continue
+		}
+		noteName, _ := noteIndexToName(uint8(i))
+		result.Keybindings = append(result.Keybindings, webKeybinding{
+			Note:    uint8(i),
+			Name:    noteName,
+			Key:     keybind.VirtualKeyCode,
+			KeyName: keyName(keybind.VirtualKeyCode),
+			Ctrl:    keybind.Ctrl,
+			Alt:     keybind.Alt,
+			Shift:   keybind.Shift,
+		})
+	}
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) keybindingsSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if h.app.KeybindingMode != "modifier" {
+		http.Error(w, "keybindings can not be saved in octave mode", 409)
+		return
+	}
+	profile, err := h.app.snapshotKeybindingProfile()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if profile != "default" {
+		http.Error(w, fmt.Sprintf("keybinding profile %s in use, switch back to default to save", profile), 409)
+		return
+	}
+	keybindings, err := h.app.snapshotKeybindings()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	err = h.app.saveKeybindings(&keybindings)
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var result struct {
+		ConfigFile string `json:"config_file"`
+	}
+	result.ConfigFile = h.app.ConfigFile
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) keybindingLearn(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method == "PUT" {
+		err = h.app.cmdStartMidiLearn()
+	} else if r.Method == "DELETE" {
+		err = h.app.cmdStopMidiLearn()
+	}
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+
+	var result struct {
+		Learning bool   `json:"learning"`
+		Note     *uint8 `json:"note"`
+		Name     string `json:"name"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Learning = snapshot.LearnActive
+	if !snapshot.LearnActive && snapshot.LearnNote >= 0 {
+		result.Note = new(uint8)
+		*result.Note = uint8(snapshot.LearnNote)
+		result.Name, _ = noteIndexToName(*result.Note)
+	}
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) keybindingProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		name := strings.TrimSpace(string(body))
+		if h.app.findKeybindingProfile(name) == nil {
+			http.Error(w, fmt.Sprintf("unknown keybinding profile %q", name), 400)
+			return
+		}
+		if h.app.KeybindingMode != "modifier" {
+			http.Error(w, "keybinding profiles are not supported in octave mode", 409)
+			return
+		}
+		err = h.app.cmdSetKeybindingProfile(name)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Profiles []string `json:"profiles"`
+		Selected string   `json:"selected"`
+	}
+	result.Profiles = []string{"default"}
+	for _, profile := range h.app.KeybindingProfile {
+		result.Profiles = append(result.Profiles, profile.Name)
+	}
+	result.Selected, _ = h.app.snapshotKeybindingProfile()
 	writeJSON(w, result)
 }
 
@@ -331,11 +722,11 @@ func (h *webHandlers) currentTime(w http.ResponseWriter, r *http.Request) {
 		Time         float64 `json:"time"`
 		MaxDeviation float64 `json:"max_deviation"`
 	}
-	synced, offset, maxDeviation := h.app.getNtpOffset()
-	now = now.Add(offset).UTC()
-	result.Synced = synced
+	snapshot := h.app.snapshotNtp()
+	now = now.Add(snapshot.ClockOffset).UTC()
+	result.Synced = snapshot.Synced
 	result.Time = float64(now.Unix()) + float64(now.Nanosecond())*1e-9
-	result.MaxDeviation = float64(maxDeviation/time.Nanosecond) * 1e-9
+	result.MaxDeviation = float64(snapshot.MaxDeviation/time.Nanosecond) * 1e-9
 	writeJSON(w, result)
 }
 
@@ -349,21 +740,18 @@ func (h *webHandlers) ntpSyncServer(w http.ResponseWriter, r *http.Request) {
 		}
 		ntpServer := string(body)
 
-		_, err = h.app.NtpGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			return nil, h.app.syncTime(ntpServer)
-		})
+		err = h.app.cmdSyncTime(ntpServer)
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 503)
 			return
 		}
-		h.app.NtpSyncServer = ntpServer
 	}
 
 	var result struct {
 		Server string `json:"server"`
 	}
-	result.Server = h.app.NtpSyncServer
+	result.Server = h.app.snapshotNtp().Server
 	writeJSON(w, result)
 }
 
@@ -376,22 +764,61 @@ func (h *webHandlers) midiPlaybackFile(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		buffer := filebuffer.New(body)
-		_, err = h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			return nil, h.app.setMidiPlaybackFile(buffer)
-		})
+		err = h.app.cmdSetMidiPlaybackFile(buffer)
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 503)
 			return
 		}
 
-		writeJSON(w, struct{}{})
+		h.midiPlaybackAnalysis(w, r)
 		return
 	}
 
 	http.Error(w, "Method Not Allowed", 405)
 }
 
+// midiPlaybackAnalysis describes each track of the loaded MIDI file. It is
+// also the response to uploading a file.
+func (h *webHandlers) midiPlaybackAnalysis(w http.ResponseWriter, r *http.Request) {
+	playbackSnapshot, err := h.app.snapshotMidiPlayback()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	realtimeSnapshot, err := h.app.snapshotMidiRealtime()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	keybindings, err := h.app.snapshotKeybindings()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if playbackSnapshot.Sequence == nil {
+		http.Error(w, "no MIDI file loaded", 400)
+		return
+	}
+
+	var result struct {
+		Format        uint16              `json:"format"`
+		Transpose     int                 `json:"transpose"`
+		SkillCooldown float64             `json:"skill_cooldown"`
+		Tracks        []midiTrackAnalysis `json:"tracks"`
+	}
+	if playbackSnapshot.Sequence.Header != nil {
+		result.Format = playbackSnapshot.Sequence.Header.Format
+	}
+	result.Transpose = realtimeSnapshot.MidiOutTranspose
+	result.SkillCooldown = float64(h.app.SkillCooldown/time.Nanosecond) * 1e-9
+	result.Tracks = h.app.analyzeMidiSequence(playbackSnapshot.Sequence, &keybindings, &realtimeSnapshot.ChannelRouting)
+	writeJSON(w, result)
+}
+
 func (h *webHandlers) midiPlaybackTrack(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "PUT" {
 		body, err := ioutil.ReadAll(r.Body)
@@ -400,16 +827,13 @@ func (h *webHandlers) midiPlaybackTrack(w http.ResponseWriter, r *http.Request)
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		value, err := strconv.ParseUint(string(body), 0, 16)
+		tracks, err := parseMidiTrackList(string(body))
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, err = h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			h.app.setMidiPlaybackTrack(uint16(value))
-			return nil, nil
-		})
+		err = h.app.cmdSetMidiPlaybackTracks(tracks)
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 400)
@@ -418,12 +842,51 @@ func (h *webHandlers) midiPlaybackTrack(w http.ResponseWriter, r *http.Request)
 	}
 
 	var result struct {
-		Track uint16 `json:"track"`
+		Track  uint16   `json:"track"`
+		Tracks []uint16 `json:"tracks"`
+		Names  []string `json:"names"`
 	}
-	h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Track = h.app.MidiPlaybackTrack
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiPlayback()
+	if len(snapshot.Tracks) != 0 {
+		result.Track = snapshot.Tracks[0]
+	}
+	result.Tracks = snapshot.Tracks
+	result.Names = []string{}
+	if snapshot.Sequence != nil {
+		for _, thisTrack := range snapshot.Sequence.Tracks {
+			result.Names = append(result.Names, midiTrackName(thisTrack))
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) midiPlaybackChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		channels, err := parseMidiChannelList(string(body))
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = h.app.cmdSetMidiPlaybackChannels(channels)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Channels []int `json:"channels"`
+	}
+	snapshot, _ := h.app.snapshotMidiPlayback()
+	result.Channels = midiChannelList(snapshot.Channels)
 	writeJSON(w, result)
 }
 
@@ -441,10 +904,7 @@ func (h *webHandlers) midiPlaybackOffset(w http.ResponseWriter, r *http.Request)
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		_, err = h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-			h.app.setMidiPlaybackOffset(time.Duration(value*1e9) * time.Nanosecond)
-			return nil, nil
-		})
+		err = h.app.cmdSetMidiPlaybackOffset(time.Duration(value*1e9) * time.Nanosecond)
 		if err != nil {
 			log.Println("Error: ", err)
 			http.Error(w, err.Error(), 400)
@@ -455,10 +915,39 @@ func (h *webHandlers) midiPlaybackOffset(w http.ResponseWriter, r *http.Request)
 	var result struct {
 		Offset float64 `json:"offset"`
 	}
-	h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		result.Offset = float64(h.app.MidiPlaybackOffset/time.Nanosecond) * 1e-9
-		return nil, nil
-	})
+	snapshot, _ := h.app.snapshotMidiPlayback()
+	result.Offset = float64(snapshot.Offset/time.Nanosecond) * 1e-9
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) midiPlaybackOutOfRangePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		policy := strings.ToLower(strings.TrimSpace(string(body)))
+		if policy != "" && !isOutOfRangePolicy(policy) {
+			http.Error(w, fmt.Sprintf("invalid out-of-range policy %q", policy), 400)
+			return
+		}
+		err = h.app.cmdSetMidiPlaybackOutOfRangePolicy(policy)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Policy  string `json:"policy"`
+		Default string `json:"default"`
+	}
+	snapshot, _ := h.app.snapshotMidiPlayback()
+	result.Policy = snapshot.OutOfRangePolicy
+	result.Default = h.app.OutOfRangePolicy
 	writeJSON(w, result)
 }
 
@@ -468,6 +957,7 @@ func (h *webHandlers) scheduler(w http.ResponseWriter, r *http.Request) {
 		StartTime    *float64 `json:"start_time"`
 		LoopEnabled  bool     `json:"loop_enabled"`
 		LoopInterval float64  `json:"loop_interval"`
+		Speed        float64  `json:"speed"`
 	}
 
 	if r.Method == "PUT" {
@@ -488,23 +978,183 @@ func (h *webHandlers) scheduler(w http.ResponseWriter, r *http.Request) {
 			i, f := math.Modf(*result.StartTime)
 			startTime = time.Unix(int64(i), int64(f*1e9))
 		}
-		h.app.setMidiPlaybackScheduler(result.Enabled, startTime, result.LoopEnabled, time.Duration(result.LoopInterval*1e9)*time.Nanosecond)
+		// Clients that do not know about speed leave it unchanged
+		if result.Speed != 0 {
+			err = h.app.cmdSetMidiPlaybackSpeed(result.Speed)
+			if err != nil {
+				log.Println("Error: ", err)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		err = h.app.cmdSetMidiPlaybackScheduler(result.Enabled, startTime, result.LoopEnabled, time.Duration(result.LoopInterval*1e9)*time.Nanosecond)
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
 	}
 
-	h.app.MidiPlaybackGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
-		var (
-			startTime    time.Time
-			loopInterval time.Duration
-		)
-		result.Enabled, startTime, result.LoopEnabled, loopInterval = h.app.getMidiPlaybackScheduler()
-		if !startTime.IsZero() {
-			startTime = startTime.UTC()
-			result.StartTime = new(float64)
-			*result.StartTime = float64(startTime.Unix()) + float64(startTime.Nanosecond())*1e-9
+	snapshot, _ := h.app.snapshotMidiPlayback()
+	result.Enabled = snapshot.ScheduleEnabled
+	result.StartTime = nil
+	if !snapshot.Schedule.IsZero() {
+		startTime := snapshot.Schedule.UTC()
+		result.StartTime = new(float64)
+		*result.StartTime = float64(startTime.Unix()) + float64(startTime.Nanosecond())*1e-9
+	}
+	result.LoopEnabled = snapshot.LoopEnabled
+	result.LoopInterval = float64(snapshot.Loop/time.Nanosecond) * 1e-9
+	result.Speed = snapshot.Speed
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) dryRun(w http.ResponseWriter, r *http.Request) {
+	playbackSnapshot, err := h.app.snapshotMidiPlayback()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	realtimeSnapshot, err := h.app.snapshotMidiRealtime()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	keybindings, err := h.app.snapshotKeybindings()
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	sequence := playbackSnapshot.Sequence
+	tracks := playbackSnapshot.Tracks
+	channels := playbackSnapshot.Channels
+	transpose := realtimeSnapshot.MidiOutTranspose
+	speed := playbackSnapshot.Speed
+	outOfRangePolicy := playbackSnapshot.OutOfRangePolicy
+
+	query := r.URL.Query()
+	if value := query.Get("track"); value != "" {
+		tracks, err = parseMidiTrackList(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if value := query.Get("channels"); value != "" {
+		channels, err = parseMidiChannelList(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
-		result.LoopInterval = float64(loopInterval/time.Nanosecond) * 1e-9
-		return nil, nil
+	}
+	if value := query.Get("transpose"); value != "" {
+		transposeValue, err := strconv.ParseInt(value, 0, 8)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		transpose = int(transposeValue)
+	}
+	if value := query.Get("speed"); value != "" {
+		speed, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = checkMidiPlaybackSpeed(speed)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if value, ok := query["out_of_range_policy"]; ok {
+		outOfRangePolicy = value[0]
+		if outOfRangePolicy != "" && !isOutOfRangePolicy(outOfRangePolicy) {
+			http.Error(w, fmt.Sprintf("invalid out-of-range policy %q", outOfRangePolicy), 400)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("unsupported format %q", format), 400)
+		return
+	}
+	if sequence == nil {
+		http.Error(w, "no MIDI file loaded", 400)
+		return
+	}
+
+	timeline, err := h.app.dryRunMidiPlayback(sequence, &dryRunOptions{
+		Tracks:           tracks,
+		Channels:         channels,
+		Transpose:        transpose,
+		Speed:            speed,
+		OutOfRangePolicy: outOfRangePolicy,
+		ChannelRouting:   realtimeSnapshot.ChannelRouting,
+		Keybinding:       keybindings,
 	})
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		err = timeline.writeCSV(w)
+		if err != nil {
+			log.Println("Error: ", err)
+		}
+		return
+	}
+	writeJSON(w, timeline)
+}
+
+func (h *webHandlers) emergencyStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		log.Println("Emergency stop requested on the web console!")
+		h.app.cmdEmergencyStop()
+	} else if r.Method == "DELETE" {
+		err := h.app.cmdRearmMidiIn()
+		if err != nil {
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), 503)
+			return
+		}
+	}
+
+	var result struct {
+		Muted bool `json:"muted"`
+	}
+	snapshot, _ := h.app.snapshotMidiRealtime()
+	result.Muted = snapshot.MidiInMuted
+	writeJSON(w, result)
+}
+
+func (h *webHandlers) statistics(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		h.app.statistics.reset(h.app.clock.Now())
+	}
+
+	var result struct {
+		Since          float64                    `json:"since"`
+		LateNotePolicy string                     `json:"late_note_policy"`
+		Played         uint64                     `json:"played"`
+		Late           uint64                     `json:"late"`
+		MaxLateness    float64                    `json:"max_lateness"`
+		Dropped        map[string]uint64          `json:"dropped"`
+		Delayed        map[string]delayStatistics `json:"delayed"`
+	}
+	snapshot := h.app.statistics.snapshot()
+	result.Since = float64(snapshot.Since.Unix()) + float64(snapshot.Since.Nanosecond())*1e-9
+	result.LateNotePolicy = h.app.LateNotePolicy
+	result.Played = snapshot.Played
+	result.Late = snapshot.Late
+	result.MaxLateness = float64(snapshot.MaxLateness/time.Nanosecond) * 1e-9
+	result.Dropped = snapshot.Dropped
+	result.Delayed = snapshot.Delayed
 	writeJSON(w, result)
 }
 
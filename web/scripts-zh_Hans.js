@@ -116,6 +116,44 @@
         })
     }
 
+    function doMidiControlRefresh(quiet) {
+        requestHTTP("GET", "/midi-control-device", null, function onLoad(event, response) {
+            var list = document.getElementById("midi-control-device");
+            suppressEvents = true;
+            try {
+                clearSelect(list);
+                addSelectOption(list, "（无）", "-1");
+                var devices = response["devices"];
+                for (var i = 0; i < devices.length; i++) {
+                    addSelectOption(list, devices[i], i);
+                }
+                list.value = response["selected"];
+            } finally {
+                suppressEvents = false;
+            }
+            if (!quiet) {
+                reportMessage("MIDI 控制设备已更新。");
+            }
+        }, function onError(event, error) {
+            reportError("无法获取 MIDI 控制设备。");
+        });
+    }
+
+    function onMidiControlRefreshClicked() {
+        return doMidiControlRefresh(false);
+    }
+
+    function onMidiControlDeviceChanged() {
+        if (suppressEvents) { return; }
+        var value = this.value;
+        var text = this.options[this.selectedIndex].text;
+        requestHTTP("PUT", "/midi-control-device", value, function onLoad(event, response) {
+            reportMessage("MIDI 控制设备已更改为 " + text + "。");
+        }, function onError(event, error) {
+            reportError(error);
+        })
+    }
+
     function doMidiOutputRefresh(quiet) {
         requestHTTP("GET", "/midi-output-device", null, function onLoad(event, response) {
             var list = document.getElementById("midi-output-device");
@@ -348,12 +386,17 @@
                 doVersionInfoUpdate();
                 doMidiInputRefresh(true);
                 doMidiOutputRefresh(true);
+                doMidiControlRefresh(true);
                 doSynthInstrumentRefresh();
                 doNTPServerUpdate();
                 doUpdateServerTime();
                 doMIDITrackNumberRefresh();
                 doMIDIOffsetMsRefresh();
+                doMIDIOutOfRangePolicyRefresh();
                 doSchedulerRefresh();
+                doEmergencyStopRefresh();
+                doKeybindingsRefresh();
+                doKeybindingProfileRefresh();
                 return setTimeout(updateAllStates, 1000, 1);
             case 1:
                 doVersionInfoUpdate();
@@ -361,6 +404,7 @@
             case 2:
                 doMidiInputRefresh(true);
                 doMidiOutputRefresh(true);
+                doMidiControlRefresh(true);
                 return setTimeout(updateAllStates, 1000, 3);
             case 3:
                 if (document.activeElement !== document.getElementById("synth-bank") && document.activeElement !== document.getElementById("synth-patch") && document.activeElement !== document.getElementById("synth-transpose")) {
@@ -374,14 +418,27 @@
                 if (document.activeElement !== document.getElementById("midi-track-number")) {
                     doMIDITrackNumberRefresh();
                 }
+                if (document.activeElement !== document.getElementById("midi-channels")) {
+                    doMIDIChannelsRefresh();
+                }
                 if (document.activeElement !== document.getElementById("midi-offset-ms")) {
                     doMIDIOffsetMsRefresh();
                 }
+                if (document.activeElement !== document.getElementById("midi-out-of-range-policy")) {
+                    doMIDIOutOfRangePolicyRefresh();
+                }
                 return setTimeout(updateAllStates, 1000, 6);
             case 6:
-                if (document.activeElement !== document.getElementById("sched-start-time") && document.activeElement !== document.getElementById("sched-loop-interval")) {
+                if (document.activeElement !== document.getElementById("sched-start-time") && document.activeElement !== document.getElementById("sched-loop-interval") && document.activeElement !== document.getElementById("sched-speed")) {
                     doSchedulerRefresh();
                 }
+                doEmergencyStopRefresh();
+                if (document.activeElement !== document.getElementById("keybinding-list")) {
+                    doKeybindingsRefresh();
+                }
+                if (document.activeElement !== document.getElementById("keybinding-profile")) {
+                    doKeybindingProfileRefresh();
+                }
                 return setTimeout(updateAllStates, 1000, 1);
         }
     }
@@ -430,7 +487,18 @@
 
     function doMIDITrackNumberRefresh() {
         requestHTTP("GET", "/midi-playback-track", null, function onLoad(event, response) {
-            document.getElementById("midi-track-number").value = response["track"];
+            document.getElementById("midi-track-number").value = response["tracks"].join(",");
+            var names = document.getElementById("midi-track-names");
+            if (names.dataset.names !== JSON.stringify(response["names"])) {
+                names.dataset.names = JSON.stringify(response["names"]);
+                names.innerHTML = "";
+                for (var i = 0; i < response["names"].length; i++) {
+                    var option = document.createElement("option");
+                    option.value = i;
+                    option.label = i + ": " + response["names"][i];
+                    names.appendChild(option);
+                }
+            }
         }, function onError(event, error) {
         });
     }
@@ -445,6 +513,34 @@
         })
     }
 
+    function doMIDIChannelsRefresh() {
+        requestHTTP("GET", "/midi-playback-channels", null, function onLoad(event, response) {
+            var channels = response["channels"];
+            document.getElementById("midi-channels").value = channels.length === 16 ? "" : channels.join(",");
+        }, function onError(event, error) {
+        });
+    }
+
+    function onMIDIChannelsChanged() {
+        if (suppressEvents) { return; }
+        var value = this.value;
+        requestHTTP("PUT", "/midi-playback-channels", value, function onLoad(event, response) {
+            reportMessage("MIDI 通道已更改。");
+        }, function onError(event, error) {
+            reportError(error);
+        })
+    }
+
+    function onMIDISuggestTransposeClicked() {
+        requestHTTP("POST", "/midi-output-transpose-suggestion", null, function onLoad(event, response) {
+            var best = response["candidates"][0];
+            reportMessage("转调已更改为 " + best["transpose"] + "，" + best["playable"] + " / " + (best["playable"] + best["out_of_range"]) + " 个音符可演奏。");
+            doSynthInstrumentRefresh();
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
     function doMIDIOffsetMsRefresh() {
         requestHTTP("GET", "/midi-playback-offset", null, function onLoad(event, response) {
             document.getElementById("midi-offset-ms").value = Math.round(response["offset"] * 1000);
@@ -461,6 +557,51 @@
         })
     }
 
+    function doMIDIOutOfRangePolicyRefresh() {
+        requestHTTP("GET", "/midi-playback-out-of-range-policy", null, function onLoad(event, response) {
+            var el = document.getElementById("midi-out-of-range-policy");
+            el.options[0].text = "默认（" + response["default"] + "）";
+            el.value = response["policy"];
+        }, function onError(event, error) {
+        });
+    }
+
+    function onMIDIOutOfRangePolicyChanged() {
+        if (suppressEvents) { return; }
+        var value = this.value;
+        requestHTTP("PUT", "/midi-playback-out-of-range-policy", value, function onLoad(event, response) {
+            reportMessage("超出音域的音符处理方式已更改为 " + (value || "默认") + "。");
+        }, function onError(event, error) {
+            reportError(error);
+        })
+    }
+
+    function doEmergencyStopRefresh() {
+        requestHTTP("GET", "/emergency-stop", null, function onLoad(event, response) {
+            document.getElementById("emergency-rearm").disabled = !response["muted"];
+        }, function onError(event, error) {
+        });
+    }
+
+    function onEmergencyStopClicked() {
+        requestHTTP("POST", "/emergency-stop", null, function onLoad(event, response) {
+            reportMessage("已紧急停止，所有按键已松开。" + (response["muted"] ? "MIDI 输入已静音，需要恢复后才能演奏。" : ""));
+            document.getElementById("emergency-rearm").disabled = !response["muted"];
+            doSchedulerRefresh();
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
+    function onEmergencyRearmClicked() {
+        requestHTTP("DELETE", "/emergency-stop", null, function onLoad(event, response) {
+            reportMessage("MIDI 输入已恢复。");
+            document.getElementById("emergency-rearm").disabled = !response["muted"];
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
     var schedulerEnabled = false;
 
     function doSchedulerRefresh() {
@@ -496,6 +637,7 @@
             } else {
                 document.getElementById("sched-loop-interval").value = "";
             }
+            document.getElementById("sched-speed").value = response["speed"];
         }, function onError(event, error) {
         });
     }
@@ -515,6 +657,11 @@
             reportError("循环间隔无效。");
             return;
         }
+        var speed = +document.getElementById("sched-speed").value;
+        if (!(speed >= 0.25 && speed <= 4)) {
+            reportError("播放速度应在 0.25 至 4 倍之间。");
+            return;
+        }
         var now = new Date();
         var startTime = null;
         if (startTimeMatch) {
@@ -555,6 +702,7 @@
             "start_time": startTime !== null ? startTime.getTime() * 0.001 : null,
             "loop_enabled": loopEnabled,
             "loop_interval": loopInterval,
+            "speed": speed,
         };
         requestHTTP("PUT", "/scheduler", JSON.stringify(body), function onLoad(event, response) {
             schedulerEnabled = response["enabled"];
@@ -568,8 +716,179 @@
         });
     }
 
+    var keybindingLearnTimer = null;
+    var keybindingLearnNote = null;
+
+    function formatKeybinding(keybinding) {
+        var keys = [];
+        if (keybinding["ctrl"]) {
+            keys.push("Ctrl");
+        }
+        if (keybinding["alt"]) {
+            keys.push("Alt");
+        }
+        if (keybinding["shift"]) {
+            keys.push("Shift");
+        }
+        keys.push(keybinding["key_name"]);
+        return keys.join(" + ");
+    }
+
+    function doKeybindingsRefresh() {
+        requestHTTP("GET", "/keybindings", null, function onLoad(event, response) {
+            var list = document.getElementById("keybinding-list");
+            var selected = list.value;
+            suppressEvents = true;
+            try {
+                clearSelect(list);
+                var keybindings = response["keybindings"];
+                for (var i = 0; i < keybindings.length; i++) {
+                    addSelectOption(list, keybindings[i]["name"] + ": " + formatKeybinding(keybindings[i]), keybindings[i]["name"]);
+                }
+                list.value = selected;
+            } finally {
+                suppressEvents = false;
+            }
+            var editable = response["mode"] === "modifier";
+            document.getElementById("keybinding-learn").disabled = !editable;
+            document.getElementById("keybinding-clear").disabled = !editable;
+            document.getElementById("keybinding-save").disabled = !editable;
+        }, function onError(event, error) {
+        });
+    }
+
+    function doKeybindingProfileRefresh() {
+        requestHTTP("GET", "/keybinding-profile", null, function onLoad(event, response) {
+            var list = document.getElementById("keybinding-profile");
+            suppressEvents = true;
+            try {
+                clearSelect(list);
+                var profiles = response["profiles"];
+                for (var i = 0; i < profiles.length; i++) {
+                    addSelectOption(list, profiles[i], profiles[i]);
+                }
+                list.value = response["selected"];
+            } finally {
+                suppressEvents = false;
+            }
+        }, function onError(event, error) {
+        });
+    }
+
+    function onKeybindingProfileChanged() {
+        if (suppressEvents) { return; }
+        var value = this.value;
+        requestHTTP("PUT", "/keybinding-profile", value, function onLoad(event, response) {
+            reportMessage("按键绑定方案已更改为 " + value + "。");
+            doKeybindingsRefresh();
+        }, function onError(event, error) {
+            reportError(error);
+        })
+    }
+
+    function onKeybindingListChanged() {
+        if (suppressEvents) { return; }
+        document.getElementById("keybinding-note").value = this.value;
+    }
+
+    function doKeybindingLearnPoll() {
+        requestHTTP("GET", "/keybinding-learn", null, function onLoad(event, response) {
+            if (response["learning"]) {
+                keybindingLearnTimer = setTimeout(doKeybindingLearnPoll, 200);
+                return;
+            }
+            keybindingLearnTimer = null;
+            if (response["note"] !== null) {
+                document.getElementById("keybinding-note").value = response["name"];
+                doKeybindingLearnKey(response["name"]);
+            }
+        }, function onError(event, error) {
+            keybindingLearnTimer = null;
+            reportError(error);
+        });
+    }
+
+    function doKeybindingLearnKey(note) {
+        keybindingLearnNote = note;
+        reportMessage("请按下 " + note + " 对应的电脑按键（按 Esc 取消）。");
+    }
+
+    function onKeybindingLearnClicked() {
+        this.blur();
+        var note = document.getElementById("keybinding-note").value.trim();
+        if (note) {
+            return doKeybindingLearnKey(note);
+        }
+        requestHTTP("PUT", "/keybinding-learn", null, function onLoad(event, response) {
+            reportMessage("请按下 MIDI 键盘上的一个键（按 Esc 取消）。");
+            keybindingLearnTimer = setTimeout(doKeybindingLearnPoll, 200);
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
+    function onKeybindingKeyDown(event) {
+        if (keybindingLearnTimer !== null && event.keyCode === 27) {
+            clearTimeout(keybindingLearnTimer);
+            keybindingLearnTimer = null;
+            requestHTTP("DELETE", "/keybinding-learn", null, function onLoad(event, response) {
+                reportMessage("已取消按键绑定。");
+            }, function onError(event, error) {
+                reportError(error);
+            });
+            return;
+        }
+        if (keybindingLearnNote === null) { return; }
+        // Wait for the key that comes with the modifiers
+        if (event.keyCode === 16 || event.keyCode === 17 || event.keyCode === 18) { return; }
+        event.preventDefault();
+        var note = keybindingLearnNote;
+        keybindingLearnNote = null;
+        if (event.keyCode === 27) {
+            reportMessage("已取消按键绑定。");
+            return;
+        }
+        var body = {
+            "name": note,
+            "key": event.keyCode,
+            "ctrl": event.ctrlKey,
+            "alt": event.altKey,
+            "shift": event.shiftKey,
+        };
+        requestHTTP("PUT", "/keybindings", JSON.stringify(body), function onLoad(event, response) {
+            doKeybindingsRefresh();
+            reportMessage(note + " 的按键绑定已更改。");
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
+    function onKeybindingClearClicked() {
+        var note = document.getElementById("keybinding-note").value.trim();
+        if (!note) {
+            reportError("请先输入音符。");
+            return;
+        }
+        requestHTTP("DELETE", "/keybindings?note=" + encodeURIComponent(note), null, function onLoad(event, response) {
+            doKeybindingsRefresh();
+            reportMessage(note + " 的按键绑定已清除。");
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
+    function onKeybindingSaveClicked() {
+        requestHTTP("POST", "/keybindings-save", null, function onLoad(event, response) {
+            reportMessage("按键绑定已保存到 " + response["config_file"] + "。");
+        }, function onError(event, error) {
+            reportError(error);
+        });
+    }
+
     document.getElementById("midi-input-refresh").addEventListener("click", onMidiInputRefreshClicked);
     document.getElementById("midi-input-device").addEventListener("change", onMidiInputDeviceChanged);
+    document.getElementById("midi-control-refresh").addEventListener("click", onMidiControlRefreshClicked);
+    document.getElementById("midi-control-device").addEventListener("change", onMidiControlDeviceChanged);
     document.getElementById("midi-output-refresh").addEventListener("click", onMidiOutputRefreshClicked);
     document.getElementById("midi-output-device").addEventListener("change", onMidiOutputDeviceChanged);
     document.getElementById("synth-bank").addEventListener("change", onSynthBankChanged);
@@ -580,11 +899,24 @@
     document.getElementById("current-time-copy").addEventListener("click", onCurrentTimeCopyClicked);
     document.getElementById("midi-file").addEventListener("change", onMIDIFileChanged);
     document.getElementById("midi-track-number").addEventListener("change", onMIDITrackNumberChanged);
+    document.getElementById("midi-channels").addEventListener("change", onMIDIChannelsChanged);
+    document.getElementById("midi-suggest-transpose").addEventListener("click", onMIDISuggestTransposeClicked);
     document.getElementById("midi-offset-ms").addEventListener("change", onMIDIOffsetMsChanged);
+    document.getElementById("midi-out-of-range-policy").addEventListener("change", onMIDIOutOfRangePolicyChanged);
     document.getElementById("sched-start-time").addEventListener("change", onSchedulerChanged);
     document.getElementById("sched-set").addEventListener("click", onSchedulerChanged);
     document.getElementById("sched-loop-enabled").addEventListener("change", onSchedulerChanged);
     document.getElementById("sched-loop-interval").addEventListener("change", onSchedulerChanged);
+    document.getElementById("sched-speed").addEventListener("change", onSchedulerChanged);
+    document.getElementById("emergency-stop").addEventListener("click", onEmergencyStopClicked);
+    document.getElementById("emergency-rearm").addEventListener("click", onEmergencyRearmClicked);
+
+    document.getElementById("keybinding-list").addEventListener("change", onKeybindingListChanged);
+    document.getElementById("keybinding-learn").addEventListener("click", onKeybindingLearnClicked);
+    document.getElementById("keybinding-clear").addEventListener("click", onKeybindingClearClicked);
+    document.getElementById("keybinding-save").addEventListener("click", onKeybindingSaveClicked);
+    document.getElementById("keybinding-profile").addEventListener("change", onKeybindingProfileChanged);
+    document.addEventListener("keydown", onKeybindingKeyDown);
 
     document.getElementById("midi-file").value = "";
     updateAllStates(0);
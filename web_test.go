@@ -0,0 +1,493 @@
+/*
+   MIDI2FFXIV
+   Copyright (C) 2017-2018 Star Brilliant <m13253@hotmail.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a
+   copy of this software and associated documentation files (the "Software"),
+   to deal in the Software without restriction, including without limitation
+   the rights to use, copy, modify, merge, publish, distribute, sublicense,
+   and/or sell copies of the Software, and to permit persons to whom the
+   Software is furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+   FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+   DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWebTest starts the executors of an application using loopback MIDI
+// ports, and returns its web handlers.
+func newWebTest(t *testing.T, p preset) *webHandlers {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	app := &application{
+		preset: p,
+	}
+	app.initState()
+	t.Cleanup(app.Quit)
+	app.keySender = nullKeySender{}
+	app.midiDriver = newLoopbackMidiDriver("Loopback A", "Loopback B")
+	app.startExecutors()
+	return app.newWebHandlers()
+}
+
+// webRequest returns the status code, and decodes the JSON response into
+// result if the request succeeds.
+func webRequest(t *testing.T, h *webHandlers, method, path, body string, result interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	h.serveMux.ServeHTTP(w, r)
+	if w.Code == http.StatusOK && result != nil {
+		err := json.Unmarshal(w.Body.Bytes(), result)
+		if err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+// expectWebResponse fails the test unless the request succeeds with the
+// JSON response want.
+func expectWebResponse(t *testing.T, h *webHandlers, method, path, body string, want interface{}) {
+	t.Helper()
+	got := reflect.New(reflect.TypeOf(want))
+	if code := webRequest(t, h, method, path, body, got.Interface()); code != http.StatusOK {
+		t.Fatalf("%s %s %q: status %d", method, path, body, code)
+	}
+	if !reflect.DeepEqual(got.Elem().Interface(), want) {
+		t.Fatalf("%s %s %q:\n got: %+v\nwant: %+v", method, path, body, got.Elem().Interface(), want)
+	}
+}
+
+// TestConcurrentWebRequests is meant to be run with "go test -race".
+// The responses are checked by TestWebEndpoints.
+func TestConcurrentWebRequests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	app := &application{
+		preset: defaultPreset,
+	}
+	app.initState()
+	defer app.Quit()
+	app.keySender = nullKeySender{}
+	driver := newLoopbackMidiDriver("Loopback A", "Loopback B")
+	app.midiDriver = driver
+	app.startExecutors()
+	h := app.newWebHandlers()
+
+	request := func(method, path, body string) error {
+		r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		h.serveMux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("%s %s %q: %d %s", method, path, body, w.Code, w.Body.String())
+		}
+		return nil
+	}
+
+	midiFile, err := ioutil.ReadFile(filepath.Join("demo", "Canon in D.mid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		request("PUT", "/midi-playback-file", string(midiFile)),
+		request("PUT", "/midi-input-device", "0"),
+		request("PUT", "/midi-output-device", "1"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Play on the MIDI input device in the meantime
+	midiIn, err := driver.OpenOutput(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for note := uint8(48); ; note = 48 + (note-47)%37 {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			_ = midiIn.Send([]byte{0x90, note, 0x40})
+			_ = midiIn.Send([]byte{0x80, note, 0x00})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				startTime := float64(time.Now().UnixNano())*1e-9 - float64(j)
+				for _, err := range []error{
+					request("PUT", "/midi-output-transpose", fmt.Sprint((i+j)%25-12)),
+					request("PUT", "/midi-playback-track", fmt.Sprintf("%d,%d", 1+(i+j)%4, 1+(i+j+1)%4)),
+					request("PUT", "/midi-playback-channels", []string{"all", "1,2"}[j%2]),
+					request("PUT", "/midi-playback-offset", fmt.Sprint(float64(j)*0.01)),
+					request("PUT", "/scheduler", fmt.Sprintf(`{"enabled":true,"start_time":%f,"loop_enabled":%v,"loop_interval":5,"speed":%g}`, startTime, j%2 == 0, 1/float64(j%3+1))),
+					request("PUT", "/midi-output-bank", fmt.Sprint(j%2)),
+					request("PUT", "/midi-output-patch", fmt.Sprint(40+j%8)),
+					request("PUT", "/midi-channel-routing", fmt.Sprintf(`{"channel":%d,"mode":"on","transpose":%d}`, 1+i, j%2*12)),
+					request("PUT", "/split-zones", fmt.Sprintf(`[{"low":0,"high":59,"transpose":%d,"chord_policy":"lowest"}]`, j%2*12)),
+					request("PUT", "/keybindings", `{"name":"C4","key":81}`),
+					request("PUT", "/keybinding-learn", ""),
+					request("DELETE", "/keybinding-learn", ""),
+					request("PUT", "/keybinding-profile", "default"),
+					request("PUT", "/midi-control-device", "-1"),
+					request("GET", "/statistics", ""),
+					request("DELETE", "/statistics", ""),
+					request("POST", "/emergency-stop", ""),
+					request("DELETE", "/emergency-stop", ""),
+					request("GET", "/midi-input-device", ""),
+					request("GET", "/midi-output-device", ""),
+					request("GET", "/current-time", ""),
+					request("GET", "/ntp-sync-server", ""),
+					request("GET", "/scheduler", ""),
+					request("GET", "/midi-playback-analysis", ""),
+					request("GET", "/midi-output-transpose-suggestion", ""),
+				} {
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				if j%10 == 0 {
+					err := request("GET", "/dry-run?format=csv&track=1,2", "")
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	err = request("PUT", "/scheduler", `{"enabled":false}`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebEndpoints(t *testing.T) {
+	p := defaultPreset
+	p.EmergencyStopMute = "on"
+	h := newWebTest(t, p)
+
+	type devices struct {
+		Devices  []string `json:"devices"`
+		Selected int      `json:"selected"`
+	}
+	loopback := []string{"Loopback A", "Loopback B"}
+	expectWebResponse(t, h, "PUT", "/midi-input-device", "0", devices{loopback, 0})
+	expectWebResponse(t, h, "PUT", "/midi-output-device", "1", devices{loopback, 1})
+	expectWebResponse(t, h, "PUT", "/midi-control-device", "-1", devices{loopback, -1})
+
+	type bank struct {
+		Bank uint16 `json:"bank"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-output-bank", "1", bank{1})
+	type patch struct {
+		Patch uint8 `json:"patch"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-output-patch", "42", patch{42})
+	type transpose struct {
+		Transpose int `json:"transpose"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-output-transpose", "-12", transpose{-12})
+	if code := webRequest(t, h, "PUT", "/midi-output-transpose", "x", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid transpose: status %d, want 400", code)
+	}
+
+	var routing struct {
+		Channels []webMidiChannelRoute `json:"channels"`
+	}
+	webRequest(t, h, "PUT", "/midi-channel-routing", `{"channel":3,"mode":"mute","transpose":12}`, &routing)
+	if len(routing.Channels) != 16 || routing.Channels[2] != (webMidiChannelRoute{3, "mute", 12}) || routing.Channels[9] != (webMidiChannelRoute{10, "off", 0}) {
+		t.Errorf("channel routing: got %+v", routing.Channels)
+	}
+	if code := webRequest(t, h, "PUT", "/midi-channel-routing", `{"channel":17,"mode":"on"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("channel 17: status %d, want 400", code)
+	}
+
+	type zones struct {
+		Zones []webSplitZone `json:"zones"`
+	}
+	expectWebResponse(t, h, "PUT", "/split-zones", `[{"low":0,"high":59,"transpose":12,"chord_policy":"Lowest"}]`, zones{[]webSplitZone{{0, 59, 12, "lowest"}}})
+	expectWebResponse(t, h, "PUT", "/split-zones", `[]`, zones{[]webSplitZone{}})
+
+	var keybindings struct {
+		Mode        string          `json:"mode"`
+		Keybindings []webKeybinding `json:"keybindings"`
+	}
+	webRequest(t, h, "PUT", "/keybindings", `{"name":"C2","key":65,"alt":true}`, &keybindings)
+	if keybindings.Mode != "modifier" || len(keybindings.Keybindings) != 38 || keybindings.Keybindings[0] != (webKeybinding{Note: 0x24, Name: "C2", Key: 'A', KeyName: "'A'", Alt: true}) {
+		t.Errorf("keybindings: got %s %+v", keybindings.Mode, keybindings.Keybindings)
+	}
+	webRequest(t, h, "DELETE", "/keybindings?note=C2", "", &keybindings)
+	if len(keybindings.Keybindings) != 37 || keybindings.Keybindings[0].Name != "C3" {
+		t.Errorf("keybindings after DELETE: got %+v", keybindings.Keybindings)
+	}
+
+	type learn struct {
+		Learning bool   `json:"learning"`
+		Note     *uint8 `json:"note"`
+		Name     string `json:"name"`
+	}
+	expectWebResponse(t, h, "PUT", "/keybinding-learn", "", learn{Learning: true})
+	expectWebResponse(t, h, "DELETE", "/keybinding-learn", "", learn{})
+
+	type profiles struct {
+		Profiles []string `json:"profiles"`
+		Selected string   `json:"selected"`
+	}
+	expectWebResponse(t, h, "PUT", "/keybinding-profile", "default", profiles{[]string{"default"}, "default"})
+	if code := webRequest(t, h, "PUT", "/keybinding-profile", "drums", nil); code != http.StatusBadRequest {
+		t.Errorf("unknown profile: status %d, want 400", code)
+	}
+
+	// Playback
+	if code := webRequest(t, h, "GET", "/midi-playback-analysis", "", nil); code != http.StatusBadRequest {
+		t.Errorf("analysis without a file: status %d, want 400", code)
+	}
+	midiFile, err := ioutil.ReadFile(filepath.Join("demo", "Canon in D.mid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var analysis struct {
+		Format        uint16              `json:"format"`
+		Transpose     int                 `json:"transpose"`
+		SkillCooldown float64             `json:"skill_cooldown"`
+		Tracks        []midiTrackAnalysis `json:"tracks"`
+	}
+	webRequest(t, h, "PUT", "/midi-playback-file", string(midiFile), &analysis)
+	if analysis.Format != 1 || analysis.Transpose != -12 || analysis.SkillCooldown != 0.125 || len(analysis.Tracks) != 5 {
+		t.Fatalf("analysis: got format %d, transpose %d, skill cooldown %g, %d tracks", analysis.Format, analysis.Transpose, analysis.SkillCooldown, len(analysis.Tracks))
+	}
+	if track := analysis.Tracks[1]; track.Track != 1 || track.Notes != 485 || track.LowestNote != "C#4" || track.HighestNote != "D6" || track.MaxPolyphony != 1 {
+		t.Errorf("analysis of track 1: got %+v", track)
+	}
+
+	type tracks struct {
+		Track  uint16   `json:"track"`
+		Tracks []uint16 `json:"tracks"`
+		Names  []string `json:"names"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-playback-track", "2, 3", tracks{2, []uint16{2, 3}, []string{"", "", "", "", ""}})
+	if code := webRequest(t, h, "PUT", "/midi-playback-track", "", nil); code != http.StatusBadRequest {
+		t.Errorf("no track: status %d, want 400", code)
+	}
+	expectWebResponse(t, h, "PUT", "/midi-playback-track", "1", tracks{1, []uint16{1}, []string{"", "", "", "", ""}})
+	type channels struct {
+		Channels []int `json:"channels"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-playback-channels", "2,1", channels{[]int{1, 2}})
+	expectWebResponse(t, h, "PUT", "/midi-playback-channels", "all", channels{[]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}})
+	type offset struct {
+		Offset float64 `json:"offset"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-playback-offset", "0.25", offset{0.25})
+	type policy struct {
+		Policy  string `json:"policy"`
+		Default string `json:"default"`
+	}
+	expectWebResponse(t, h, "PUT", "/midi-playback-out-of-range-policy", "fold", policy{"fold", "drop"})
+	expectWebResponse(t, h, "PUT", "/midi-playback-out-of-range-policy", "", policy{"", "drop"})
+
+	var suggestion struct {
+		Transpose  int                  `json:"transpose"`
+		Candidates []transposeCandidate `json:"candidates"`
+	}
+	webRequest(t, h, "POST", "/midi-output-transpose-suggestion", "", &suggestion)
+	if len(suggestion.Candidates) != 7 || suggestion.Candidates[0] != (transposeCandidate{12, 485, 0, 94}) || suggestion.Transpose != 12 {
+		t.Errorf("transpose suggestion: got %+v", suggestion)
+	}
+	webRequest(t, h, "GET", "/midi-output-transpose-suggestion?semitones=true", "", &suggestion)
+	if len(suggestion.Candidates) != 73 || suggestion.Candidates[0].Playable != 485 {
+		t.Errorf("transpose suggestion in semitones: got %d candidates, best %+v", len(suggestion.Candidates), suggestion.Candidates[0])
+	}
+
+	type scheduler struct {
+		Enabled      bool     `json:"enabled"`
+		StartTime    *float64 `json:"start_time"`
+		LoopEnabled  bool     `json:"loop_enabled"`
+		LoopInterval float64  `json:"loop_interval"`
+		Speed        float64  `json:"speed"`
+	}
+	var result scheduler
+	webRequest(t, h, "PUT", "/scheduler", `{"enabled":false,"start_time":1.5e9,"loop_enabled":true,"loop_interval":60,"speed":0.5}`, &result)
+	if result.Enabled || result.StartTime == nil || *result.StartTime != 1.5e9 || !result.LoopEnabled || math.Abs(result.LoopInterval-60) > 1e-6 || result.Speed != 0.5 {
+		t.Errorf("scheduler: got %+v", result)
+	}
+	// A client that does not know about speed leaves it unchanged
+	expectWebResponse(t, h, "PUT", "/scheduler", `{"enabled":false,"start_time":null}`, scheduler{false, nil, false, 0, 0.5})
+	if code := webRequest(t, h, "PUT", "/scheduler", `{"speed":8}`, nil); code != http.StatusBadRequest {
+		t.Errorf("speed 8: status %d, want 400", code)
+	}
+
+	var timeline dryRunTimeline
+	webRequest(t, h, "GET", "/dry-run?track=1&transpose=12&speed=2", "", &timeline)
+	if timeline.Track != 1 || timeline.Transpose != 12 || timeline.Speed != 2 || len(timeline.Entries) == 0 {
+		t.Errorf("dry run: got track %d, transpose %d, speed %g, %d entries", timeline.Track, timeline.Transpose, timeline.Speed, len(timeline.Entries))
+	}
+	r := httptest.NewRequest("GET", "/dry-run?format=csv", nil)
+	w := httptest.NewRecorder()
+	h.serveMux.ServeHTTP(w, r)
+	if !strings.HasPrefix(w.Body.String(), "time,event,key,note,delay,reason\n") {
+		t.Errorf("dry run in CSV: got %q", w.Body.String())
+	}
+
+	var statistics struct {
+		LateNotePolicy string                     `json:"late_note_policy"`
+		Played         uint64                     `json:"played"`
+		Dropped        map[string]uint64          `json:"dropped"`
+		Delayed        map[string]delayStatistics `json:"delayed"`
+	}
+	webRequest(t, h, "DELETE", "/statistics", "", &statistics)
+	if statistics.LateNotePolicy != "drop" || statistics.Played != 0 || len(statistics.Dropped) != 0 || len(statistics.Delayed) != 0 {
+		t.Errorf("statistics: got %+v", statistics)
+	}
+
+	type muted struct {
+		Muted bool `json:"muted"`
+	}
+	expectWebResponse(t, h, "POST", "/emergency-stop", "", muted{true})
+	expectWebResponse(t, h, "GET", "/emergency-stop", "", muted{true})
+	expectWebResponse(t, h, "DELETE", "/emergency-stop", "", muted{false})
+}
+
+func TestSplitZones(t *testing.T) {
+	h := newWebTest(t, defaultPreset)
+	zoneOf := func(key uint8) int {
+		t.Helper()
+		result, err := h.app.MidiRealtimeGoro.Submit(h.app.ctx, func(context.Context) (interface{}, error) {
+			zone, _ := h.app.findSplitZone(key)
+			return zone, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(int)
+	}
+
+	for _, test := range []struct {
+		body  string
+		code  int
+		zones map[uint8]int
+	}{
+		{`[]`, http.StatusOK, map[uint8]int{0x00: 0, 0x3c: 0, 0x7f: 0}},
+		{`[{"low":0,"high":59}]`, http.StatusOK, map[uint8]int{0x00: 1, 0x3b: 1, 0x3c: 0, 0x7f: 0}},
+		{`[{"low":60,"high":127},{"low":0,"high":59}]`, http.StatusOK, map[uint8]int{0x00: 2, 0x3b: 2, 0x3c: 1, 0x7f: 1}},
+		{`[{"low":48,"high":59},{"low":72,"high":83}]`, http.StatusOK, map[uint8]int{0x2f: 0, 0x30: 1, 0x3b: 1, 0x3c: 0, 0x47: 0, 0x48: 2, 0x53: 2, 0x54: 0}},
+		{`[{"low":60,"high":60}]`, http.StatusOK, map[uint8]int{0x3b: 0, 0x3c: 1, 0x3d: 0}},
+		{`[{"low":59,"high":0}]`, http.StatusBadRequest, nil},
+		{`[{"low":0,"high":128}]`, http.StatusBadRequest, nil},
+		{`[{"low":0,"high":60},{"low":60,"high":127}]`, http.StatusBadRequest, nil},
+		{`[{"low":48,"high":59},{"low":0,"high":127}]`, http.StatusBadRequest, nil},
+		{`[{"low":0,"high":59,"chord_policy":"loudest"}]`, http.StatusBadRequest, nil},
+	} {
+		// A rejected request keeps the zones of the last one
+		webRequest(t, h, "PUT", "/split-zones", `[{"low":0,"high":127}]`, nil)
+		if code := webRequest(t, h, "PUT", "/split-zones", test.body, nil); code != test.code {
+			t.Errorf("PUT %s: status %d, want %d", test.body, code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			if zone := zoneOf(0x3c); zone != 1 {
+				t.Errorf("PUT %s: C4 sent to zone %d after the error, want 1", test.body, zone)
+			}
+			continue
+		}
+		for key, want := range test.zones {
+			if zone := zoneOf(key); zone != want {
+				t.Errorf("PUT %s: key %#02x sent to zone %d, want %d", test.body, key, zone, want)
+			}
+		}
+	}
+}
+
+func TestKeybindingProfiles(t *testing.T) {
+	p := defaultPreset
+	drums := keybindingProfile{Name: "drums"}
+	drums.Keybinding[0x24] = keybindingPreset{VirtualKeyCode: 'D'}
+	p.KeybindingProfile = []keybindingProfile{drums}
+	h := newWebTest(t, p)
+
+	type keybindings struct {
+		Mode        string          `json:"mode"`
+		Keybindings []webKeybinding `json:"keybindings"`
+	}
+	var got keybindings
+	webRequest(t, h, "PUT", "/keybindings", `{"name":"C2","key":65}`, &got)
+	if len(got.Keybindings) != 38 {
+		t.Fatalf("keybindings: got %+v", got.Keybindings)
+	}
+
+	webRequest(t, h, "PUT", "/keybinding-profile", "drums", nil)
+	expectWebResponse(t, h, "GET", "/keybindings", "", keybindings{"modifier", []webKeybinding{{Note: 0x24, Name: "C2", Key: 'D', KeyName: "'D'"}}})
+	if code := webRequest(t, h, "POST", "/keybindings-save", "", nil); code != http.StatusConflict {
+		t.Errorf("save with profile drums: status %d, want 409", code)
+	}
+
+	webRequest(t, h, "PUT", "/keybinding-profile", "default", nil)
+	webRequest(t, h, "GET", "/keybindings", "", &got)
+	if len(got.Keybindings) != 38 || got.Keybindings[0] != (webKeybinding{Note: 0x24, Name: "C2", Key: 'A', KeyName: "'A'"}) {
+		t.Errorf("keybindings after switching back: got %+v", got.Keybindings)
+	}
+
+	// Reloading the config file changes profile "default" in the background
+	webRequest(t, h, "PUT", "/keybinding-profile", "drums", nil)
+	reloaded := defaultPreset.Keybinding
+	reloaded[0x30] = keybindingPreset{}
+	if err := h.app.cmdSetDefaultKeybindings(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	webRequest(t, h, "PUT", "/keybinding-profile", "default", nil)
+	webRequest(t, h, "GET", "/keybindings", "", &got)
+	if len(got.Keybindings) != 36 || got.Keybindings[0].Name != "C#3" {
+		t.Errorf("keybindings reloaded with profile drums: got %+v", got.Keybindings)
+	}
+}